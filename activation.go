@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// activatedSockets returns the sockets passed by systemd socket activation
+// (sd_listen_fds(3)), ok is false if the process wasn't socket activated.
+func activatedSockets() (conns []*net.UDPConn, lns []*net.TCPListener, ok bool, err error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil, false, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil, false, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		if pc, perr := net.FilePacketConn(f); perr == nil {
+			conn, isUDP := pc.(*net.UDPConn)
+			if !isUDP {
+				pc.Close()
+				f.Close()
+				return nil, nil, false, fmt.Errorf("fd %d isn't an udp socket", fd)
+			}
+			conns = append(conns, conn)
+		} else if l, lerr := net.FileListener(f); lerr == nil {
+			ln, isTCP := l.(*net.TCPListener)
+			if !isTCP {
+				l.Close()
+				f.Close()
+				return nil, nil, false, fmt.Errorf("fd %d isn't a tcp socket", fd)
+			}
+			lns = append(lns, ln)
+		} else {
+			f.Close()
+			return nil, nil, false, fmt.Errorf("fd %d isn't a socket: %w", fd, lerr)
+		}
+		// the conns and listeners hold a dup of the descriptor
+		f.Close()
+	}
+	return conns, lns, true, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/heliorosa/dcdns/resolver"
+	"gopkg.in/yaml.v3"
+)
+
+// settings are the flags a config file can set too.
+type settings struct {
+	bind, suffix    string
+	forward, allow  string
+	port            int
+	ttl             uint
+	dockerHost      string
+	dockerCertPath  string
+	dockerTLSVerify bool
+}
+
+func (s *settings) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.bind, "bind", "127.0.0.127", "comma separated list of ips to bind")
+	fs.IntVar(&s.port, "port", 5353, "port to bind (udp and tcp)")
+	fs.StringVar(&s.suffix, "suffix", "docker", "comma separated list of domain name suffixes")
+	fs.UintVar(&s.ttl, "ttl", 60, "answer ttl in seconds")
+	fs.StringVar(&s.forward, "forward", "", "upstream dns server (host:port) for names outside the suffixes and reverse lookups of other ips")
+	fs.StringVar(&s.allow, "allow", defaultAllow, "comma separated list of networks to answer queries from, others are dropped")
+	fs.StringVar(&s.dockerHost, "docker-host", "", "comma separated list of docker daemons to resolve the containers of (e.g. tcp://10.0.0.5:2376), DOCKER_HOST if empty; a container on several resolves to the first listed's")
+	fs.BoolVar(&s.dockerTLSVerify, "docker-tls-verify", false, "use tls and verify the docker daemon")
+	fs.StringVar(&s.dockerCertPath, "docker-cert-path", defaultCertPath(), "directory holding ca.pem, cert.pem and key.pem for -docker-tls-verify")
+}
+
+// restartOnly returns the settings that only apply at startup.
+func (s *settings) restartOnly() settings {
+	return settings{
+		bind:            s.bind,
+		port:            s.port,
+		dockerHost:      s.dockerHost,
+		dockerCertPath:  s.dockerCertPath,
+		dockerTLSVerify: s.dockerTLSVerify,
+	}
+}
+
+// parse checks the settings and returns the parsed bind ips, suffixes and
+// allowed networks.
+func (s *settings) parse() ([]net.IP, []string, []*net.IPNet, error) {
+	if s.port < 1 || s.port > 65535 {
+		return nil, nil, nil, fmt.Errorf("port out of range: %d", s.port)
+	}
+	if s.ttl > math.MaxUint32 {
+		return nil, nil, nil, fmt.Errorf("ttl out of range: %d", s.ttl)
+	}
+	var bindIPs []net.IP
+	for _, b := range strings.Split(s.bind, ",") {
+		ip := net.ParseIP(strings.TrimSpace(b))
+		if ip == nil {
+			return nil, nil, nil, fmt.Errorf("invalid bind ip: %q", b)
+		}
+		bindIPs = append(bindIPs, ip)
+	}
+	if s.forward != "" {
+		if err := validateUpstream(s.forward); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid forward address %q: %w", s.forward, err)
+		}
+	}
+	allowNets, err := parseCIDRs(s.allow)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid allow list: %w", err)
+	}
+	suffixes := resolver.ParseSuffixes(s.suffix)
+	if len(suffixes) == 0 {
+		return nil, nil, nil, fmt.Errorf("no domain name suffix")
+	}
+	return bindIPs, suffixes, allowNets, nil
+}
+
+// validateUpstream checks addr is an ip:port pair.
+func validateUpstream(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("not an ip: %q", host)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port: %q", port)
+	}
+	return nil
+}
+
+// hostsFlag is the repeatable -host flag, mapping names to fixed addresses.
+type hostsFlag map[string][]net.IP
+
+func (h hostsFlag) String() string {
+	var entries []string
+	for name, ips := range h {
+		for _, ip := range ips {
+			entries = append(entries, name+"="+ip.String())
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+func (h hostsFlag) Set(v string) error {
+	name, addr, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("not name=ip: %q", v)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("not an ip: %q", addr)
+	}
+	h[name] = append(h[name], ip)
+	return nil
+}
+
+// zonesFlag is the repeatable -docker-zone flag, mapping suffixes to the
+// docker hosts answering for them.
+type zonesFlag map[string]string
+
+func (z zonesFlag) String() string {
+	var entries []string
+	for suffix, hosts := range z {
+		entries = append(entries, suffix+"="+hosts)
+	}
+	return strings.Join(entries, " ")
+}
+
+func (z zonesFlag) Set(v string) error {
+	suffix, hosts, ok := strings.Cut(v, "=")
+	suffix = strings.ToLower(strings.Trim(suffix, "."))
+	if !ok || suffix == "" || hosts == "" {
+		return fmt.Errorf("not suffix=host: %q", v)
+	}
+	z[suffix] = hosts
+	return nil
+}
+
+// fileConfig is the yaml file given with -config, its keys are named after
+// the flags. Lists are yaml sequences, missing keys leave the flags alone.
+type fileConfig struct {
+	Bind    []string `yaml:"bind"`
+	Port    *int     `yaml:"port"`
+	Suffix  []string `yaml:"suffix"`
+	TTL     *uint    `yaml:"ttl"`
+	Forward *string  `yaml:"forward"`
+	Allow   []string `yaml:"allow"`
+
+	DockerHost      *string `yaml:"docker-host"`
+	DockerTLSVerify *bool   `yaml:"docker-tls-verify"`
+	DockerCertPath  *string `yaml:"docker-cert-path"`
+}
+
+// validate rejects the values the flags would take but can't be meant, like
+// an empty list of suffixes. The rest is checked along with the flags.
+func (fc *fileConfig) validate() error {
+	for key, list := range map[string][]string{"bind": fc.Bind, "suffix": fc.Suffix, "allow": fc.Allow} {
+		if list != nil && len(list) == 0 {
+			return fmt.Errorf("empty %s list", key)
+		}
+		for _, v := range list {
+			if strings.TrimSpace(v) == "" {
+				return fmt.Errorf("empty %s entry", key)
+			}
+		}
+	}
+	if fc.Port != nil && (*fc.Port < 1 || *fc.Port > 65535) {
+		return fmt.Errorf("port out of range: %d", *fc.Port)
+	}
+	return nil
+}
+
+// values returns the flag values given by the file, by flag name.
+func (fc *fileConfig) values() map[string]string {
+	v := make(map[string]string)
+	lists := map[string][]string{"bind": fc.Bind, "suffix": fc.Suffix, "allow": fc.Allow}
+	for name, list := range lists {
+		if list != nil {
+			v[name] = strings.Join(list, ",")
+		}
+	}
+	strs := map[string]*string{"forward": fc.Forward, "docker-host": fc.DockerHost, "docker-cert-path": fc.DockerCertPath}
+	for name, str := range strs {
+		if str != nil {
+			v[name] = *str
+		}
+	}
+	if fc.Port != nil {
+		v["port"] = strconv.Itoa(*fc.Port)
+	}
+	if fc.TTL != nil {
+		v["ttl"] = strconv.FormatUint(uint64(*fc.TTL), 10)
+	}
+	if fc.DockerTLSVerify != nil {
+		v["docker-tls-verify"] = strconv.FormatBool(*fc.DockerTLSVerify)
+	}
+	return v
+}
+
+// applyConfig sets the flags of fs to the values in the config file at path,
+// except those in given (set on the command line), which take precedence.
+func applyConfig(fs *flag.FlagSet, path string, given map[string]bool) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var fc fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err = dec.Decode(&fc); err != nil && err != io.EOF {
+		return fmt.Errorf("can't parse %s: %w", path, err)
+	}
+	if err = fc.validate(); err != nil {
+		return fmt.Errorf("invalid %s: %w", path, err)
+	}
+	for name, v := range fc.values() {
+		if given[name] {
+			continue
+		}
+		if err = fs.Set(name, v); err != nil {
+			return fmt.Errorf("invalid %s in %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// givenFlags returns the names of the flags set on the command line.
+func givenFlags(fs *flag.FlagSet) map[string]bool {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	return given
+}
+
+// reloadSettings reads the config file again on top of the command line
+// flags, for SIGHUP. Flags given on the command line keep their value.
+func reloadSettings(path string, given map[string]bool) (*settings, error) {
+	var s settings
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	s.register(fs)
+	for name := range given {
+		if f := flag.Lookup(name); f != nil && fs.Lookup(name) != nil {
+			fs.Set(name, f.Value.String())
+		}
+	}
+	if err := applyConfig(fs, path, given); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// reload rereads the config file and applies the suffixes, ttl, upstream
+// server and allowed networks to the queries answered from now on, the ttl
+// to those of the docker zones too. The sockets and the docker connection
+// stay as they were at startup, changing them needs a restart.
+func (s *server) reload(path string, given map[string]bool, started *settings) {
+	next, err := reloadSettings(path, given)
+	if err != nil {
+		slog.Error("can't reload config", "err", err)
+		return
+	}
+	_, suffixes, allowNets, err := next.parse()
+	if err != nil {
+		slog.Error("can't reload config", "err", err)
+		return
+	}
+	if next.restartOnly() != started.restartOnly() {
+		slog.Warn("bind, port and docker changes need a restart")
+	}
+	s.res.Reload(resolver.Config{Suffixes: suffixes, TTL: uint32(next.ttl), Forward: next.forward})
+	// zones keep their suffix and forward nothing, like at startup
+	for _, z := range s.zones {
+		z.res.Reload(resolver.Config{Suffixes: []string{z.suffix}, TTL: uint32(next.ttl)})
+	}
+	s.allow.Store(&allowNets)
+	slog.Info("config reloaded", "path", path)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// newDockerClient connects to host, or to the daemon named by the
+// environment (DOCKER_HOST and friends) if host is empty. With tlsVerify the
+// client authenticates with ca.pem, cert.pem and key.pem from certPath.
+func newDockerClient(host string, tlsVerify bool, certPath string) (*client.Client, error) {
+	if host == "" && !tlsVerify {
+		return client.NewEnvClient()
+	}
+	opts := []client.Opt{client.FromEnv}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	if tlsVerify {
+		opts = append(opts, client.WithTLSClientConfig(
+			filepath.Join(certPath, "ca.pem"),
+			filepath.Join(certPath, "cert.pem"),
+			filepath.Join(certPath, "key.pem"),
+		))
+	}
+	return client.NewClientWithOpts(opts...)
+}
+
+// dialDocker connects to each of the comma separated hosts, see
+// newDockerClient.
+func dialDocker(hosts string, tlsVerify bool, certPath string, failFast bool) (multiClient, error) {
+	var m multiClient
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		c, err := newReconnectingClient(func() (*client.Client, error) {
+			return newDockerClient(host, tlsVerify, certPath)
+		}, failFast)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		m = append(m, c)
+	}
+	return m, nil
+}
+
+func defaultCertPath() string {
+	if p := os.Getenv("DOCKER_CERT_PATH"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+const (
+	// reconnectAfter is how many requests in a row must fail to reach the
+	// daemon before the client is recreated.
+	reconnectAfter = 3
+	minBackoff     = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// errDockerDown is returned without asking the daemon while it's
+// unreachable, if failing fast.
+var errDockerDown = errors.New("docker unreachable")
+
+// reconnectingClient recreates the docker client when the daemon keeps being
+// unreachable (e.g. it restarted), backing off between attempts. Requests in
+// flight keep the client they started with. With failFast, requests made
+// while the daemon is unreachable fail right away instead of timing out,
+// but for one per backoff that checks whether it's back.
+type reconnectingClient struct {
+	dial     func() (*client.Client, error)
+	cl       atomic.Pointer[client.Client]
+	failFast bool
+
+	mu       sync.Mutex
+	failures int
+	down     bool
+	probing  bool // a request is checking whether the daemon is back
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+func newReconnectingClient(dial func() (*client.Client, error), failFast bool) (*reconnectingClient, error) {
+	cl, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c := &reconnectingClient{dial: dial, failFast: failFast, backoff: minBackoff}
+	c.cl.Store(cl)
+	return c, nil
+}
+
+// unreachable reports whether err means the daemon couldn't be reached.
+func unreachable(err error) bool {
+	return client.IsErrConnectionFailed(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// fast returns errDockerDown if the request about to be made should fail
+// fast. Once the backoff is over the first request goes through as the
+// probe, the others keep failing until it's answered.
+func (c *reconnectingClient) fast() error {
+	if !c.failFast {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.down {
+		return nil
+	}
+	if c.probing || time.Now().Before(c.retryAt) {
+		return errDockerDown
+	}
+	c.probing = true
+	return nil
+}
+
+// check counts the request failing with err and reconnects once there are
+// enough of them in a row. While the daemon is down, it reconnects again
+// once per backoff: on the probe failing, or on any request failing once
+// the backoff is over if not failing fast.
+func (c *reconnectingClient) check(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	probe := c.probing
+	c.probing = false
+	if !unreachable(err) {
+		if c.down {
+			slog.Info("docker reachable again")
+		}
+		c.failures, c.backoff, c.down = 0, minBackoff, false
+		return
+	}
+	c.failures++
+	if !c.down && c.failures < reconnectAfter {
+		return
+	}
+	if c.down && !probe && time.Now().Before(c.retryAt) {
+		return
+	}
+	if !c.down && c.failFast {
+		slog.Warn("docker unreachable, failing queries until it's back", "err", err)
+	}
+	c.down = true
+	c.retryAt = time.Now().Add(c.backoff)
+	if c.backoff *= 2; c.backoff > maxBackoff {
+		c.backoff = maxBackoff
+	}
+	cl, err := c.dial()
+	if err != nil {
+		slog.Warn("can't reconnect to docker", "err", err)
+		return
+	}
+	c.cl.Swap(cl).Close()
+	c.failures = 0
+	slog.Info("reconnected to docker")
+}
+
+func (c *reconnectingClient) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	if err := c.fast(); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	info, err := c.cl.Load().ContainerInspect(ctx, container)
+	c.check(err)
+	return info, err
+}
+
+func (c *reconnectingClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	if err := c.fast(); err != nil {
+		return nil, err
+	}
+	containers, err := c.cl.Load().ContainerList(ctx, options)
+	c.check(err)
+	return containers, err
+}
+
+func (c *reconnectingClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return c.cl.Load().Events(ctx, options)
+}
+
+func (c *reconnectingClient) ServiceInspectWithRaw(ctx context.Context, serviceID string, opts types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+	if err := c.fast(); err != nil {
+		return swarm.Service{}, nil, err
+	}
+	svc, raw, err := c.cl.Load().ServiceInspectWithRaw(ctx, serviceID, opts)
+	c.check(err)
+	return svc, raw, err
+}
+
+func (c *reconnectingClient) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	if err := c.fast(); err != nil {
+		return nil, err
+	}
+	nets, err := c.cl.Load().NetworkList(ctx, options)
+	c.check(err)
+	return nets, err
+}
+
+func (c *reconnectingClient) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	if err := c.fast(); err != nil {
+		return types.NetworkResource{}, err
+	}
+	n, err := c.cl.Load().NetworkInspect(ctx, networkID, options)
+	c.check(err)
+	return n, err
+}
+
+func (c *reconnectingClient) Ping(ctx context.Context) error {
+	_, err := c.cl.Load().Ping(ctx)
+	c.check(err)
+	return err
+}
+
+func (c *reconnectingClient) Close() error {
+	return c.cl.Load().Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// While the daemon is down, failing fast, requests fail without asking it
+// but for one probe per backoff, which reconnects when it fails too.
+func TestReconnectProbes(t *testing.T) {
+	host := "unix://" + filepath.Join(t.TempDir(), "docker.sock")
+	dials := 0
+	c, err := newReconnectingClient(func() (*client.Client, error) {
+		dials++
+		return client.NewClientWithOpts(client.WithHost(host), client.WithAPIVersionNegotiation())
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	list := func() error {
+		_, err := c.ContainerList(context.Background(), types.ContainerListOptions{})
+		return err
+	}
+	for i := 0; i < reconnectAfter; i++ {
+		if err := list(); errors.Is(err, errDockerDown) || !unreachable(err) {
+			t.Fatalf("request %d: %v, want the daemon unreachable", i, err)
+		}
+	}
+	if dials != 2 {
+		t.Fatalf("%d dials after %d failures, want a reconnect", dials, reconnectAfter)
+	}
+	for probe := 0; probe < 3; probe++ {
+		if err := list(); !errors.Is(err, errDockerDown) {
+			t.Fatalf("probe %d: %v during the backoff, want %v", probe, err, errDockerDown)
+		}
+		c.mu.Lock()
+		c.retryAt = time.Now()
+		c.mu.Unlock()
+		// the probe reaches the daemon, then backs off again
+		if err := list(); errors.Is(err, errDockerDown) {
+			t.Fatalf("probe %d: failed fast", probe)
+		}
+		if err := list(); !errors.Is(err, errDockerDown) {
+			t.Fatalf("probe %d: %v after the probe, want %v", probe, err, errDockerDown)
+		}
+		if dials != 3+probe {
+			t.Errorf("probe %d: %d dials, want %d", probe, dials, 3+probe)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// Limits of the DNS over HTTPS server on slow or idle clients, which would
+// otherwise hold their connections open for as long as they like.
+const (
+	dohReadTimeout  = 5 * time.Second
+	dohWriteTimeout = 10 * time.Second
+	dohIdleTimeout  = 2 * time.Minute
+)
+
+// dohHandler serves DNS over HTTPS (RFC 8484) on /dns-query, queries are
+// sent as the dns parameter of a GET or the body of a POST.
+func (s *server) dohHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "bad remote address", http.StatusBadRequest)
+			return
+		}
+		p, _ := strconv.Atoi(port)
+		from := &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+		if !s.allowed(from.IP) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !s.underLimit(from.IP) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		m, status, err := dohQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		rb, err := s.handle(m, from, false)
+		if err != nil {
+			slog.Warn("can't reply", "client", from, "err", err)
+			http.Error(w, "can't reply", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dnsMessageType)
+		if ttl, ok := minTTL(rb); ok {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+		}
+		w.Write(rb)
+	})
+	return mux
+}
+
+// dohQuery returns the wire format query of r, or the status to fail with.
+func dohQuery(r *http.Request) ([]byte, int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		m, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(m) == 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid dns parameter")
+		}
+		return m, 0, nil
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("content type must be %s", dnsMessageType)
+		}
+		m, err := io.ReadAll(io.LimitReader(r.Body, 0xffff+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if len(m) == 0 || len(m) > 0xffff {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid query size")
+		}
+		return m, 0, nil
+	}
+	return nil, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed")
+}
+
+// minTTL returns the lowest ttl of the records in the reply rb, the time
+// it may be cached for, false if there are none.
+func minTTL(rb []byte) (uint32, bool) {
+	var r dnsmessage.Message
+	if err := r.Unpack(rb); err != nil {
+		return 0, false
+	}
+	var (
+		ttl uint32
+		ok  bool
+	)
+	for _, sec := range [][]dnsmessage.Resource{r.Answers, r.Authorities, r.Additionals} {
+		for _, rr := range sec {
+			// the opt record's ttl holds flags
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header.TTL < ttl {
+				ttl, ok = rr.Header.TTL, true
+			}
+		}
+	}
+	return ttl, ok
+}
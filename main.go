@@ -2,130 +2,540 @@ package main
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"log/slog"
+	"math"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/docker/docker/client"
-	"golang.org/x/net/dns/dnsmessage"
+	"github.com/heliorosa/dcdns/resolver"
 )
 
 func main() {
 	var (
-		bindIP, nameSuffix string
-		bindPort           int
+		cur               settings
+		configPath        string
+		netName, logLevel string
+		compose           bool
+		showVersion       bool
+		metricsAddr       string
+		adminAddr         string
+		adminToken        string
+		healthAddr        string
+		txtLabels         string
+		swarmMode         bool
+		singleQuestion    bool
+		requireHealthy    bool
+		bareNames         bool
+		refuseRecursion   bool
+		fuzzy             bool
+		dumpMessages      bool
+		warm              bool
+		txtID             bool
+		netZone           bool
+		hostnames         bool
+		maxUDPSize        int
+		hosts             = hostsFlag{}
+		runUser, runGroup string
+		family            string
+		tlsCert, tlsKey   string
+		dotPort           int
+		dohAddr           string
+		nameLabel         string
+		cnameLabel        string
+		ttlLabel          string
+		ambiguous         string
+		filterLabel       string
+		dockerZones       = zonesFlag{}
+		inspectRetries    int
+		nsName            string
+		labelPrefix       string
+		resolveMode       string
+		wildcard          string
+		gatewayName       string
+		apex              string
+		gatewayNetwork    string
+		queryLogPath      string
+		queryLogFormat    string
+		workers           int
+		rate              float64
+		burst             int
+		soaRefresh        uint
+		soaRetry          uint
+		soaExpire         uint
+		soaMinTTL         uint
+		nxdomainTTL       uint
+		dockerTimeout     time.Duration
+		failFast          bool
+		negCache          time.Duration
+		refresh           time.Duration
 	)
-	flag.StringVar(&bindIP, "bind", "127.0.0.127", "ip to bind")
-	flag.IntVar(&bindPort, "port", 5353, "port to bind")
-	flag.StringVar(&nameSuffix, "suffix", "docker", "domain name suffix")
-	flag.Parse()
-	dockerClient, err := client.NewEnvClient()
+	cur.register(flag.CommandLine)
+	flag.StringVar(&configPath, "config", "", "yaml config file, reread on SIGHUP; flags given take precedence")
+	flag.StringVar(&nsName, "ns", defaultNSName(), "name of this server in the zones' NS and SOA records")
+	flag.UintVar(&soaRefresh, "soa-refresh", 3600, "soa refresh in seconds")
+	flag.UintVar(&soaRetry, "soa-retry", 600, "soa retry in seconds")
+	flag.UintVar(&soaExpire, "soa-expire", 86400, "soa expire in seconds")
+	flag.UintVar(&soaMinTTL, "soa-minttl", 60, "soa minimum ttl in seconds")
+	flag.UintVar(&nxdomainTTL, "nxdomain-ttl", 15, "seconds clients may cache NXDOMAIN and NODATA answers, given by the soa sent with them; -soa-minttl if zero")
+	flag.StringVar(&family, "family", "", "network to listen with: udp4, udp6 or udp (dual stack), the bind ip's family if empty")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate file to serve dns over tls with, along with -tls-key, disabled if empty")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key file of -tls-cert")
+	flag.IntVar(&dotPort, "dot-port", 853, "port to serve dns over tls on")
+	flag.StringVar(&dohAddr, "doh", "", "address to serve dns over https on (e.g. :8443) with -tls-cert, disabled if empty")
+	flag.StringVar(&metricsAddr, "metrics", "", "address to serve prometheus metrics on (e.g. :9153), disabled if empty")
+	flag.IntVar(&maxUDPSize, "max-udp-size", resolver.DefaultMaxUDPSize, "largest udp query read and reply sent to edns clients, in bytes")
+	flag.IntVar(&workers, "workers", runtime.NumCPU()*4, "number of udp query workers")
+	flag.StringVar(&adminAddr, "admin", "", "address to serve the admin api on (e.g. :8053), disabled if empty")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token the admin api requires, none if empty")
+	flag.StringVar(&healthAddr, "health", "", "address to serve /healthz on (e.g. :8080), disabled if empty")
+	flag.StringVar(&netName, "network", "", "prefer the address on this docker network")
+	flag.DurationVar(&dockerTimeout, "docker-timeout", 500*time.Millisecond, "timeout of docker requests made to answer a query")
+	flag.IntVar(&inspectRetries, "inspect-retries", 1, "times a failed container inspect is retried within -docker-timeout")
+	flag.BoolVar(&failFast, "fail-fast", false, "answer SERVFAIL right away while docker is unreachable instead of trying it on every query")
+	flag.Var(dockerZones, "docker-zone", "suffix=hosts answered from the comma separated docker hosts instead of -docker-host, may be repeated; -metrics and -admin only cover -docker-host")
+	flag.StringVar(&nameLabel, "name-label", "dcdns.name", "container label giving an additional name to resolve the container by")
+	flag.StringVar(&cnameLabel, "cname-label", "dcdns.cname", "container label giving comma separated names answered as cnames for the container")
+	flag.StringVar(&ttlLabel, "ttl-label", "dcdns.ttl", "container label giving the ttl in seconds of the container's addresses, instead of -ttl")
+	flag.StringVar(&labelPrefix, "label-prefix", "", "label name and separator (e.g. role-) making names like role-db resolve to the containers labelled role=db, disabled if empty")
+	flag.StringVar(&resolveMode, "resolve", "container", "addresses to answer for containers publishing ports: container or host (the docker host's)")
+	flag.Var(hosts, "host", "name=ip answered under the suffixes ahead of containers, may be repeated")
+	flag.StringVar(&apex, "apex", "", "comma separated list of ips the zone apex (docker.) resolves to, none if empty")
+	flag.StringVar(&gatewayName, "gateway-name", "", "name (e.g. host) answered with the bridge network's gateway, the docker host as seen by containers, disabled if empty")
+	flag.StringVar(&gatewayNetwork, "gateway-network", "", "bridge network whose gateway -gateway-name resolves to, the default bridge if empty")
+	flag.StringVar(&filterLabel, "filter-label", "", "only resolve containers with this label, key=value or key (e.g. dcdns.enabled=true), all if empty")
+	flag.StringVar(&ambiguous, "ambiguous", resolver.AmbiguousAll, "answer for names matching several containers (id prefixes): all (their addresses), nxdomain or servfail")
+	flag.StringVar(&wildcard, "wildcard", "", "container name or ip to resolve names matching no container to, disabled if empty")
+	flag.StringVar(&txtLabels, "txt-labels", "", "prefix of the container labels answered in TXT records, none if empty")
+	flag.BoolVar(&hostnames, "hostnames", false, "also resolve containers by the hostname they were started with, inspecting each new container when the index is rebuilt")
+	flag.BoolVar(&netZone, "net-zone", false, "answer <network>.net.<suffix> with the docker network's gateways (A, AAAA) and subnets (TXT), ahead of containers named like that")
+	flag.BoolVar(&txtID, "txt-id", false, "answer TXT queries for id.<name> with the container's full id")
+	flag.BoolVar(&swarmMode, "swarm", false, "resolve swarm services to their virtual ips, needs a manager node")
+	flag.BoolVar(&singleQuestion, "single-question", false, "answer queries with more than one question with FORMERR instead of answering the first")
+	flag.BoolVar(&requireHealthy, "require-healthy", false, "don't resolve containers with a healthcheck until they're healthy")
+	flag.BoolVar(&refuseRecursion, "no-recursion-refused", false, "answer queries asking for recursion with REFUSED when there's no -forward server; by default they're answered without recursing")
+	flag.BoolVar(&bareNames, "bare-names", false, "also resolve single label names (web.) as containers, may shadow top level domains")
+	flag.BoolVar(&fuzzy, "fuzzy", false, "resolve names matching no container to the only container whose name contains them")
+	flag.BoolVar(&compose, "compose", false, "resolve compose services as service.project")
+	flag.DurationVar(&refresh, "refresh", 0, "answer from an index of all running containers rebuilt this often and on container events (e.g. 30s), instead of inspecting containers per query; disabled if zero")
+	flag.BoolVar(&warm, "warm", false, "look started containers up as their event comes in, so the first query for them is answered from the cache")
+	flag.DurationVar(&negCache, "negcache", 0, "how long to remember names docker doesn't know about (e.g. 5s), disabled if zero")
+	flag.Float64Var(&rate, "rate", 0, "queries per second answered per client ip, others are dropped, unlimited if zero")
+	flag.IntVar(&burst, "burst", 100, "queries a client ip may send at once on top of -rate")
+	flag.StringVar(&queryLogPath, "querylog", "", "file to log every query to, reopened on SIGHUP, disabled if empty")
+	flag.StringVar(&queryLogFormat, "querylog-format", "text", "query log format (text, json)")
+	flag.StringVar(&runUser, "user", "", "user to switch to once the sockets are bound, stays the same if empty")
+	flag.StringVar(&runGroup, "group", "", "group to switch to along with -user, the user's primary group if empty")
+	flag.BoolVar(&dumpMessages, "dump", false, "log every query and reply in full, with -loglevel debug")
+	flag.StringVar(&logLevel, "loglevel", "info", "log level (debug, info, warn, error)")
+	flag.BoolVar(&showVersion, "version", false, "print the version and exit")
+	args := os.Args[1:]
+	resolveCmd := len(args) > 0 && args[0] == "resolve"
+	if resolveCmd {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	names := flag.Args()
+	if !resolveCmd && flag.Arg(0) == "resolve" {
+		resolveCmd, names = true, flag.Args()[1:]
+	}
+	if showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		slog.Error("invalid log level", "level", logLevel)
+		os.Exit(-3)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	given := givenFlags(flag.CommandLine)
+	if configPath != "" {
+		if err := applyConfig(flag.CommandLine, configPath, given); err != nil {
+			slog.Error("can't load config", "err", err)
+			os.Exit(-3)
+		}
+	}
+	bindIPs, suffixes, allowNets, err := cur.parse()
+	if err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(-3)
+	}
+	if workers < 1 {
+		slog.Error("workers must be at least 1", "workers", workers)
+		os.Exit(-3)
+	}
+	if rate < 0 || (rate > 0 && burst < 1) {
+		slog.Error("rate must not be negative and burst at least 1", "rate", rate, "burst", burst)
+		os.Exit(-3)
+	}
+	if maxUDPSize < 512 || maxUDPSize > 65535 {
+		slog.Error("max udp size out of range", "size", maxUDPSize)
+		os.Exit(-3)
+	}
+	if inspectRetries < 0 {
+		slog.Error("inspect retries can't be negative", "retries", inspectRetries)
+		os.Exit(-3)
+	}
+	if dockerTimeout <= 0 {
+		slog.Error("docker timeout must be positive", "timeout", dockerTimeout)
+		os.Exit(-3)
+	}
+	for name, v := range map[string]uint{"soa-refresh": soaRefresh, "soa-retry": soaRetry, "soa-expire": soaExpire, "soa-minttl": soaMinTTL, "nxdomain-ttl": nxdomainTTL} {
+		if v > math.MaxUint32 {
+			slog.Error(name+" out of range", name, v)
+			os.Exit(-3)
+		}
+	}
+	switch family {
+	case "", "udp4", "udp6", "udp":
+	default:
+		slog.Error("invalid family", "family", family)
+		os.Exit(-3)
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		slog.Error("-tls-cert and -tls-key go together")
+		os.Exit(-3)
+	}
+	if dohAddr != "" && tlsCert == "" {
+		slog.Error("-doh needs -tls-cert and -tls-key")
+		os.Exit(-3)
+	}
+	if tlsCert != "" && (dotPort < 1 || dotPort > 65535) {
+		slog.Error("dot port out of range", "port", dotPort)
+		os.Exit(-3)
+	}
+	switch ambiguous {
+	case resolver.AmbiguousAll, resolver.AmbiguousNXDomain, resolver.AmbiguousServFail:
+	default:
+		slog.Error("invalid ambiguous policy", "ambiguous", ambiguous)
+		os.Exit(-3)
+	}
+	var apexIPs []net.IP
+	for _, a := range strings.Split(apex, ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		ip := net.ParseIP(a)
+		if ip == nil {
+			slog.Error("invalid apex ip", "ip", a)
+			os.Exit(-3)
+		}
+		apexIPs = append(apexIPs, ip)
+	}
+	var hostIP net.IP
+	switch resolveMode {
+	case "container":
+	case "host":
+		if hostIP, err = primaryIP(); err != nil {
+			slog.Error("can't find the host ip", "err", err)
+			os.Exit(-3)
+		}
+	default:
+		slog.Error("invalid resolve mode", "resolve", resolveMode)
+		os.Exit(-3)
+	}
+	var (
+		qlog       *queryLog
+		qlogLogger *slog.Logger
+	)
+	if queryLogPath != "" {
+		if queryLogFormat != "text" && queryLogFormat != "json" {
+			slog.Error("invalid query log format", "format", queryLogFormat)
+			os.Exit(-3)
+		}
+		if qlog, err = openQueryLog(queryLogPath); err != nil {
+			slog.Error("can't open query log", "err", err)
+			os.Exit(-3)
+		}
+		if queryLogFormat == "json" {
+			qlogLogger = slog.New(slog.NewJSONHandler(qlog, nil))
+		} else {
+			qlogLogger = slog.New(slog.NewTextHandler(qlog, nil))
+		}
+	}
+	dockerClient, err := dialDocker(cur.dockerHost, cur.dockerTLSVerify, cur.dockerCertPath, failFast)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "can't connect to docker:", err)
+		slog.Error("can't connect to docker", "err", err)
 		os.Exit(-1)
 	}
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(bindIP), Port: bindPort})
+	cfg := resolver.Config{
+		Suffixes:        suffixes,
+		TTL:             uint32(cur.ttl),
+		Forward:         cur.forward,
+		Network:         netName,
+		NameLabel:       nameLabel,
+		LabelPrefix:     labelPrefix,
+		CNAMELabel:      cnameLabel,
+		Compose:         compose,
+		NegativeTTL:     negCache,
+		NSName:          nsName,
+		DockerTimeout:   dockerTimeout,
+		Refresh:         refresh,
+		HostIP:          hostIP,
+		Wildcard:        wildcard,
+		QueryLog:        qlogLogger,
+		TXTLabels:       txtLabels,
+		Swarm:           swarmMode,
+		SingleQuestion:  singleQuestion,
+		RequireHealthy:  requireHealthy,
+		BareNames:       bareNames,
+		RefuseRecursion: refuseRecursion,
+		Fuzzy:           fuzzy,
+		Hosts:           hosts,
+		ApexIPs:         apexIPs,
+		DumpMessages:    dumpMessages,
+		Warm:            warm,
+		TXTID:           txtID,
+		NetZone:         netZone,
+		Hostnames:       hostnames,
+		MaxUDPSize:      maxUDPSize,
+		TTLLabel:        ttlLabel,
+		Ambiguous:       ambiguous,
+		FilterLabel:     filterLabel,
+		InspectRetries:  inspectRetries,
+		GatewayName:     gatewayName,
+		GatewayNetwork:  gatewayNetwork,
+		SOA: resolver.SOA{
+			Refresh: uint32(soaRefresh),
+			Retry:   uint32(soaRetry),
+			Expire:  uint32(soaExpire),
+			MinTTL:  uint32(soaMinTTL),
+		},
+		NXDomainTTL: uint32(nxdomainTTL),
+	}
+	res := resolver.New(dockerClient, cfg)
+	var zones []zone
+	for suffix, hosts := range dockerZones {
+		zc, err := dialDocker(hosts, cur.dockerTLSVerify, cur.dockerCertPath, failFast)
+		if err != nil {
+			slog.Error("can't connect to docker", "suffix", suffix, "err", err)
+			os.Exit(-1)
+		}
+		zcfg := cfg
+		zcfg.Suffixes, zcfg.Forward = []string{suffix}, ""
+		// the server still recurses through the main resolver's forwarder,
+		// there being none here is no reason to refuse
+		zcfg.RefuseRecursion = cfg.RefuseRecursion && cfg.Forward == ""
+		zones = append(zones, zone{suffix: suffix, res: resolver.New(zc, zcfg), cl: zc})
+	}
+	sortZones(zones)
+	if resolveCmd {
+		os.Exit(resolveNames(os.Stdout, &server{res: res, zones: zones}, suffixes, names))
+	}
+	conns, lns, activated, err := activatedSockets()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "can't open socket:", err)
+		slog.Error("can't use the sockets passed by systemd", "err", err)
+		os.Exit(-2)
+	}
+	if activated {
+		slog.Info("socket activated, ignoring -bind and -port", "udp", len(conns), "tcp", len(lns))
+	} else if conns, lns, err = listen(bindIPs, cur.port, family); err != nil {
+		slog.Error("can't open socket", "err", err)
 		os.Exit(-2)
 	}
-	defer conn.Close()
-	b := make([]byte, 4096)
-	for {
-		n, addr, err := conn.ReadFromUDP(b)
+	var (
+		udpConns []net.PacketConn
+		tcpLns   []net.Listener
+	)
+	for _, conn := range conns {
+		udpConns = append(udpConns, conn)
+	}
+	for _, ln := range lns {
+		tcpLns = append(tcpLns, ln)
+	}
+	if tlsCert != "" {
+		dot, err := listenTLS(bindIPs, dotPort, family, tlsCert, tlsKey)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "socket read error:", err)
-			continue
+			slog.Error("can't open tls socket", "err", err)
+			os.Exit(-2)
+		}
+		tcpLns = append(tcpLns, dot...)
+	}
+	var (
+		dohLn  net.Listener
+		dohTLS *tls.Config
+	)
+	if dohAddr != "" {
+		if dohLn, dohTLS, err = listenDoH(dohAddr, tlsCert, tlsKey); err != nil {
+			slog.Error("can't open doh socket", "err", err)
+			os.Exit(-2)
+		}
+	}
+	if runUser != "" {
+		if err = dropPrivileges(runUser, runGroup); err != nil {
+			slog.Error("can't drop privileges", "user", runUser, "err", err)
+			os.Exit(-2)
+		}
+	} else if runGroup != "" {
+		slog.Error("-group needs -user")
+		os.Exit(-3)
+	}
+	srv := &server{res: res, zones: zones, workers: workers, maxUDP: maxUDPSize}
+	srv.allow.Store(&allowNets)
+	if rate > 0 {
+		srv.limit = newRateLimiter(rate, burst)
+	}
+	if metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", srv.res.Metrics())
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				slog.Error("metrics server error", "err", err)
+			}
+		}()
+	}
+	if adminAddr != "" {
+		admin := srv.res.AdminHandler()
+		if adminToken != "" {
+			admin = requireToken(adminToken, admin)
 		}
-		go func(m []byte, addr *net.UDPAddr, cl *client.Client) {
-			msg, err := replyDNS(m, cl, nameSuffix)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "can't create reply:", err)
-				return
+		go func() {
+			if err := http.ListenAndServe(adminAddr, admin); err != nil {
+				slog.Error("admin server error", "err", err)
 			}
-			rb, err := msg.Pack()
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "can't pack message:", err)
-				return
+		}()
+	}
+	if dohLn != nil {
+		go func() {
+			doh := &http.Server{
+				Handler:           srv.dohHandler(),
+				TLSConfig:         dohTLS,
+				ReadHeaderTimeout: dohReadTimeout,
+				ReadTimeout:       dohReadTimeout,
+				WriteTimeout:      dohWriteTimeout,
+				IdleTimeout:       dohIdleTimeout,
 			}
-			if _, err = conn.WriteToUDP(rb, addr); err != nil {
-				fmt.Fprintln(os.Stderr, "can't write to socket:", err)
-				return
+			// the certificate is in dohTLS already
+			if err := doh.ServeTLS(dohLn, "", ""); err != nil {
+				slog.Error("doh server error", "err", err)
 			}
-		}(b[:n], addr, dockerClient)
+		}()
 	}
-}
-
-func replyDNS(msg []byte, cl *client.Client, suffix string) (*dnsmessage.Message, error) {
-	r := &dnsmessage.Message{}
-	if err := r.Unpack(msg); err != nil {
-		return nil, err
+	if healthAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(healthAddr, srv.healthHandler(dockerClient.Ping, dockerTimeout)); err != nil {
+				slog.Error("health server error", "err", err)
+			}
+		}()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		for _, ln := range tcpLns {
+			ln.Close()
+		}
+	}()
+	if qlog != nil || configPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			started := cur
+			for range hup {
+				if qlog != nil {
+					if err := qlog.reopen(); err != nil {
+						slog.Error("can't reopen query log", "err", err)
+					}
+				}
+				if configPath != "" {
+					srv.reload(configPath, given, &started)
+				}
+			}
+		}()
 	}
-	if r.Header.Response {
-		return nil, fmt.Errorf("go a response instead of a query")
+	if qlog != nil {
+		go qlog.flushEvery(ctx, time.Second)
 	}
-	if len(r.Questions) < 1 {
-		return nil, fmt.Errorf("no questions")
+	for _, r := range srv.resolvers() {
+		go r.SweepCache(ctx, time.Minute)
+		if refresh > 0 {
+			go r.RefreshIndex(ctx, refresh)
+		}
+		go r.WatchEvents(ctx)
 	}
-	r.RecursionAvailable = false
-	r.RecursionDesired = false
-	r.Response = true
-	r.Questions = r.Questions[:1]
-	q := r.Questions[0]
-	if q.Type != dnsmessage.TypeA || q.Class != dnsmessage.ClassINET {
-		r.RCode = dnsmessage.RCodeNameError
-		return r, nil
+	if srv.limit != nil {
+		go srv.limit.sweepEvery(ctx, time.Minute)
 	}
-	cn := string(q.Name.Data[:q.Name.Length])
-	if !strings.HasSuffix(cn, "."+suffix+".") {
-		r.RCode = dnsmessage.RCodeNameError
-		return r, nil
+	// secrets are only said to be set
+	slog.Info("starting",
+		"version", versionString(),
+		"bind", cur.bind,
+		"port", cur.port,
+		"socket_activated", activated,
+		"suffixes", suffixes,
+		"ttl", cur.ttl,
+		"docker_hosts", dockerClient.hosts(),
+		"docker_zones", dockerZones.String(),
+		"forward", cur.forward,
+		"allow", cur.allow,
+		"negcache", negCache,
+		"refresh", refresh,
+		"rate", rate,
+		"metrics", metricsAddr,
+		"admin", adminAddr,
+		"admin_token_set", adminToken != "",
+		"health", healthAddr,
+		"dot", tlsCert != "",
+		"doh", dohAddr,
+		"querylog", queryLogPath,
+		"config", configPath,
+	)
+	srv.serve(ctx, udpConns, tcpLns)
+	if qlog != nil {
+		qlog.Close()
+	}
+	dockerClient.Close()
+	for _, z := range zones {
+		z.cl.Close()
 	}
-	ip, err := resolveContainerName(cl, strings.TrimSuffix(cn, "."+suffix+"."))
-	if err != nil {
-		if !client.IsErrNotFound(err) {
-			return nil, err
-		}
-		r.RCode = dnsmessage.RCodeNameError
-		return r, nil
-	}
-	r.RCode = dnsmessage.RCodeSuccess
-	r.Answers = append(make([]dnsmessage.Resource, 0, 1), dnsmessage.Resource{
-		Header: dnsmessage.ResourceHeader{
-			Name:  q.Name,
-			Type:  q.Type,
-			Class: q.Class,
-			TTL:   60,
-		},
-		Body: &dnsmessage.AResource{A: ip},
-	})
-	return r, nil
 }
 
-func resolveContainerName(cl *client.Client, name string) ([4]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel()
-	info, err := cl.ContainerInspect(ctx, name)
+// defaultNSName returns the host name, empty (dcdns under each zone) if it
+// can't be found.
+func defaultNSName() string {
+	name, err := os.Hostname()
 	if err != nil {
-		return [4]byte{}, err
+		return ""
 	}
-	netInfo, ok := info.NetworkSettings.Networks[string(info.HostConfig.NetworkMode)]
-	if !ok {
-		for _, netInfo = range info.NetworkSettings.Networks {
-			ok = true
-			break
-		}
-		if !ok {
-			return [4]byte{}, fmt.Errorf("error getting network info for %s", name)
-		}
-	}
-	ip := net.ParseIP(netInfo.IPAddress).To4()
-	if len(ip) == 0 {
-		return [4]byte{}, errors.New("can't get IP address")
+	return name
+}
+
+// primaryIP returns the address of the interface holding the default route.
+// Nothing is sent, connecting an udp socket only picks the source address.
+func primaryIP() (net.IP, error) {
+	c, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return nil, err
 	}
-	return [4]byte{ip[0], ip[1], ip[2], ip[3]}, nil
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+type server struct {
+	res     *resolver.Resolver
+	zones   []zone // answered by other docker hosts than res
+	workers int
+	maxUDP  int // largest query read
+	allow   atomic.Pointer[[]*net.IPNet]
+	limit   *rateLimiter // nil if unlimited
+	serving atomic.Bool
+
+	// wg tracks udp workers and tcp connections
+	wg sync.WaitGroup
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/heliorosa/dcdns/resolver"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// multiClient aggregates the containers of several docker daemons, asking
+// all of them at once. A container found on more than one gets the answer
+// of the daemon listed first, lists are the containers of every daemon
+// that could be reached.
+type multiClient []*reconnectingClient
+
+// firstFound calls call on every client in parallel and returns the result
+// of the first listed that succeeded. If none did, the first error that
+// isn't a not found one is returned, not found if they all are.
+func firstFound[T any](m multiClient, call func(c *reconnectingClient) (T, error)) (T, error) {
+	if len(m) == 1 {
+		return call(m[0])
+	}
+	results := make([]T, len(m))
+	errs := make([]error, len(m))
+	var wg sync.WaitGroup
+	for i, c := range m {
+		wg.Add(1)
+		go func(i int, c *reconnectingClient) {
+			defer wg.Done()
+			results[i], errs[i] = call(c)
+		}(i, c)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			return results[i], nil
+		}
+	}
+	var zero T
+	for _, err := range errs {
+		if !client.IsErrNotFound(err) {
+			return zero, err
+		}
+	}
+	return zero, errs[0]
+}
+
+// allListed calls call on every client in parallel and returns the results
+// joined, failing only if every client did.
+func allListed[T any](m multiClient, call func(c *reconnectingClient) ([]T, error)) ([]T, error) {
+	if len(m) == 1 {
+		return call(m[0])
+	}
+	results := make([][]T, len(m))
+	errs := make([]error, len(m))
+	var wg sync.WaitGroup
+	for i, c := range m {
+		wg.Add(1)
+		go func(i int, c *reconnectingClient) {
+			defer wg.Done()
+			results[i], errs[i] = call(c)
+		}(i, c)
+	}
+	wg.Wait()
+	var (
+		all []T
+		ok  bool
+	)
+	for i, err := range errs {
+		if err == nil {
+			all, ok = append(all, results[i]...), true
+		}
+	}
+	if !ok {
+		return nil, errs[0]
+	}
+	return all, nil
+}
+
+func (m multiClient) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	return firstFound(m, func(c *reconnectingClient) (types.ContainerJSON, error) {
+		return c.ContainerInspect(ctx, container)
+	})
+}
+
+func (m multiClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	return allListed(m, func(c *reconnectingClient) ([]types.Container, error) {
+		return c.ContainerList(ctx, options)
+	})
+}
+
+func (m multiClient) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	return allListed(m, func(c *reconnectingClient) ([]types.NetworkResource, error) {
+		return c.NetworkList(ctx, options)
+	})
+}
+
+func (m multiClient) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	return firstFound(m, func(c *reconnectingClient) (types.NetworkResource, error) {
+		return c.NetworkInspect(ctx, networkID, options)
+	})
+}
+
+func (m multiClient) ServiceInspectWithRaw(ctx context.Context, serviceID string, opts types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+	type inspected struct {
+		svc swarm.Service
+		raw []byte
+	}
+	r, err := firstFound(m, func(c *reconnectingClient) (inspected, error) {
+		svc, raw, err := c.ServiceInspectWithRaw(ctx, serviceID, opts)
+		return inspected{svc, raw}, err
+	})
+	return r.svc, r.raw, err
+}
+
+// Events merges the event streams of all the daemons, the first error ends
+// them all.
+func (m multiClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	if len(m) == 1 {
+		return m[0].Events(ctx, options)
+	}
+	msgs := make(chan events.Message)
+	errs := make(chan error, 1)
+	for _, c := range m {
+		cmsgs, cerrs := c.Events(ctx, options)
+		go func() {
+			for {
+				select {
+				case msg := <-cmsgs:
+					select {
+					case msgs <- msg:
+					case <-ctx.Done():
+						return
+					}
+				case err := <-cerrs:
+					select {
+					case errs <- err:
+					default:
+					}
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return msgs, errs
+}
+
+// Ping fails unless every daemon is reachable.
+func (m multiClient) Ping(ctx context.Context) error {
+	for _, c := range m {
+		if err := c.Ping(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiClient) Close() error {
+	for _, c := range m {
+		c.Close()
+	}
+	return nil
+}
+
+// hosts returns the addresses of the daemons.
+func (m multiClient) hosts() []string {
+	var hosts []string
+	for _, c := range m {
+		hosts = append(hosts, c.cl.Load().DaemonHost())
+	}
+	return hosts
+}
+
+// zone is a suffix answered from other docker hosts than the default ones,
+// with -docker-zone. The metrics and admin api only cover the default
+// resolver, not those of the zones.
+type zone struct {
+	suffix string
+	res    *resolver.Resolver
+	cl     multiClient
+}
+
+// sortZones sorts zones longest suffix first, so names in nested zones are
+// routed to the innermost, like suffixes are matched.
+func sortZones(zones []zone) {
+	sort.Slice(zones, func(i, j int) bool { return len(zones[i].suffix) > len(zones[j].suffix) })
+}
+
+// resolvers returns the default resolver followed by those of the zones.
+func (s *server) resolvers() []*resolver.Resolver {
+	rs := []*resolver.Resolver{s.res}
+	for _, z := range s.zones {
+		rs = append(rs, z.res)
+	}
+	return rs
+}
+
+// handle returns the reply to the query in m from the resolver of the zone
+// the name falls in, the default one otherwise. Reverse lookups are answered
+// by the first zone the ip is a container of, the default resolver if it's
+// none of theirs, which forwards them if it forwards lookups. udp tells
+// whether m came in on a udp listener.
+func (s *server) handle(m []byte, from net.Addr, udp bool) ([]byte, error) {
+	if len(s.zones) == 0 {
+		return s.res.Handle(m, from, udp)
+	}
+	if isReverse(m) {
+		for _, z := range s.zones {
+			// zones don't forward, anything but NXDOMAIN is theirs
+			if r, err := z.res.Reply(m); err == nil && r.RCode != dnsmessage.RCodeNameError {
+				return z.res.Handle(m, from, udp)
+			}
+		}
+		return s.res.Handle(m, from, udp)
+	}
+	return s.resolverFor(m).Handle(m, from, udp)
+}
+
+// resolverFor returns the resolver answering the question of m: that of the
+// zone the name falls in, the default one otherwise, queries that can't be
+// parsed included.
+func (s *server) resolverFor(m []byte) *resolver.Resolver {
+	if len(s.zones) == 0 {
+		return s.res
+	}
+	if z := s.zoneOf(questionName(m)); z != nil {
+		return z.res
+	}
+	return s.res
+}
+
+// isReverse reports whether m asks for a PTR record.
+func isReverse(m []byte) bool {
+	var p dnsmessage.Parser
+	if _, err := p.Start(m); err != nil {
+		return false
+	}
+	q, err := p.Question()
+	return err == nil && q.Type == dnsmessage.TypePTR
+}
+
+// zoneOf returns the zone name falls in, nil if none does. Zones are sorted
+// longest suffix first, so nested ones get their names.
+func (s *server) zoneOf(name string) *zone {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i, z := range s.zones {
+		if name == z.suffix || strings.HasSuffix(name, "."+z.suffix) {
+			return &s.zones[i]
+		}
+	}
+	return nil
+}
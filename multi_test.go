@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/heliorosa/dcdns/resolver"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// zonesServer returns a server answering web.docker with 10.0.0.1 and, from
+// the prod.docker zone, web.prod.docker with 10.0.0.2.
+func zonesServer(t *testing.T) *server {
+	s := testServer(t)
+	s.res = resolver.New(nil, resolver.Config{
+		Suffixes: []string{"docker"},
+		TTL:      60,
+		Hosts:    map[string][]net.IP{"web": {net.IPv4(10, 0, 0, 1)}},
+	})
+	s.zones = []zone{{suffix: "prod.docker", res: resolver.New(nil, resolver.Config{
+		Suffixes: []string{"prod.docker"},
+		TTL:      60,
+		Hosts:    map[string][]net.IP{"web": {net.IPv4(10, 0, 0, 2)}},
+	})}}
+	return s
+}
+
+// answerA returns the address and ttl the server answers name with.
+func answerA(t *testing.T, s *server, name string) (string, uint32) {
+	t.Helper()
+	m := packQuery(t, 1, name)
+	r, err := s.resolverFor(m).Reply(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answers) != 1 {
+		t.Fatalf("%s: rcode %v, %d answers", name, r.RCode, len(r.Answers))
+	}
+	a := r.Answers[0]
+	return net.IP(a.Body.(*dnsmessage.AResource).A[:]).String(), a.Header.TTL
+}
+
+func TestZoneRouting(t *testing.T) {
+	s := zonesServer(t)
+	tests := []struct {
+		name string
+		zone string
+		ip   string
+	}{
+		{"web.docker.", "", "10.0.0.1"},
+		{"web.prod.docker.", "prod.docker", "10.0.0.2"},
+		{"WEB.Prod.Docker.", "prod.docker", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		var zone string
+		if z := s.zoneOf(tt.name); z != nil {
+			zone = z.suffix
+		}
+		if zone != tt.zone {
+			t.Errorf("%s: in zone %q, want %q", tt.name, zone, tt.zone)
+		}
+		if ip, _ := answerA(t, s, tt.name); ip != tt.ip {
+			t.Errorf("%s: %s, want %s", tt.name, ip, tt.ip)
+		}
+	}
+	for _, name := range []string{"prod.docker.example.", "webprod.docker."} {
+		if z := s.zoneOf(name); z != nil {
+			t.Errorf("%s: in zone %q, want none", name, z.suffix)
+		}
+	}
+}
+
+// Reloading the config applies its ttl to the zones too, they keep their
+// suffix.
+func TestReloadZones(t *testing.T) {
+	s := zonesServer(t)
+	path := filepath.Join(t.TempDir(), "dcdns.yaml")
+	if err := os.WriteFile(path, []byte("ttl: 5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	started, err := reloadSettings(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.reload(path, nil, started)
+	for _, name := range []string{"web.docker.", "web.prod.docker."} {
+		if _, ttl := answerA(t, s, name); ttl != 5 {
+			t.Errorf("%s: ttl %d after reloading, want 5", name, ttl)
+		}
+	}
+	if ip, _ := answerA(t, s, "web.prod.docker."); ip != "10.0.0.2" {
+		t.Errorf("web.prod.docker: %s after reloading, want 10.0.0.2", ip)
+	}
+}
+
+// listDocker is a docker client only listing its containers, the other calls
+// panic.
+type listDocker struct {
+	resolver.DockerClient
+	containers []types.Container
+}
+
+func (d listDocker) ContainerList(context.Context, types.ContainerListOptions) ([]types.Container, error) {
+	return d.containers, nil
+}
+
+// running returns a running container named name, with ip on the bridge.
+func running(name, ip string) types.Container {
+	return types.Container{
+		ID:    name + "-id",
+		Names: []string{"/" + name},
+		State: "running",
+		NetworkSettings: &types.SummaryNetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"bridge": {IPAddress: ip},
+		}},
+	}
+}
+
+// Reverse lookups go to the zone knowing the address, the default resolver
+// answers the rest.
+func TestZoneReverse(t *testing.T) {
+	s := testServer(t)
+	s.res = resolver.New(listDocker{containers: []types.Container{running("web", "172.17.0.2")}},
+		resolver.Config{Suffixes: []string{"docker"}, TTL: 60})
+	s.zones = []zone{{suffix: "prod.docker", res: resolver.New(listDocker{containers: []types.Container{running("api", "172.18.0.2")}},
+		resolver.Config{Suffixes: []string{"prod.docker"}, TTL: 60})}}
+	tests := []struct {
+		name  string
+		rcode dnsmessage.RCode
+		ptr   string
+	}{
+		{"2.0.17.172.in-addr.arpa.", dnsmessage.RCodeSuccess, "web.docker."},
+		{"2.0.18.172.in-addr.arpa.", dnsmessage.RCodeSuccess, "api.prod.docker."},
+		{"3.0.18.172.in-addr.arpa.", dnsmessage.RCodeNameError, ""},
+	}
+	for _, tt := range tests {
+		q, err := (&dnsmessage.Message{Questions: []dnsmessage.Question{{
+			Name: dnsmessage.MustNewName(tt.name), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET,
+		}}}).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := s.handle(q, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r dnsmessage.Message
+		if err := r.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		if r.RCode != tt.rcode {
+			t.Errorf("%s: rcode %v, want %v", tt.name, r.RCode, tt.rcode)
+			continue
+		}
+		var ptr string
+		if len(r.Answers) == 1 {
+			ptr = r.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String()
+		}
+		if ptr != tt.ptr {
+			t.Errorf("%s: ptr %q, want %q", tt.name, ptr, tt.ptr)
+		}
+	}
+}
+
+func TestSortZones(t *testing.T) {
+	zones := []zone{{suffix: "a.docker"}, {suffix: "b.a.docker"}, {suffix: "c.docker"}}
+	sortZones(zones)
+	s := &server{zones: zones}
+	tests := []struct{ name, zone string }{
+		{"web.b.a.docker.", "b.a.docker"},
+		{"web.a.docker.", "a.docker"},
+		{"b.a.docker.", "b.a.docker"},
+		{"web.c.docker.", "c.docker"},
+	}
+	for _, tt := range tests {
+		if z := s.zoneOf(tt.name); z == nil || z.suffix != tt.zone {
+			t.Errorf("%s: in zone %v, want %q", tt.name, z, tt.zone)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches to userName and groupName once the sockets are
+// bound. The group defaults to the user's primary group, the supplementary
+// groups are the user's (e.g. docker, to keep reaching its socket). Since
+// go 1.16 setuid and setgid apply to every thread of the process.
+func dropPrivileges(userName, groupName string) error {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("uid of %s: %w", userName, err)
+	}
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return fmt.Errorf("gid of %s: %w", groupName, err)
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return fmt.Errorf("groups of %s: %w", userName, err)
+	}
+	groups := []int{gid}
+	for _, g := range groupIDs {
+		if id, err := strconv.Atoi(g); err == nil && id != gid {
+			groups = append(groups, id)
+		}
+	}
+	// groups first, the user may not change them anymore
+	if err = syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return nil
+}
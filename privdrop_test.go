@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// privdropChildEnv runs TestDropPrivileges as the child process that drops
+// them, the parent test process keeps running as root.
+const privdropChildEnv = "DCDNS_PRIVDROP_CHILD"
+
+// Sockets bound as root keep working once running as nobody.
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv(privdropChildEnv) != "" {
+		dropPrivilegesChild(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$", "-test.v")
+	cmd.Env = append(os.Environ(), privdropChildEnv+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("child: %v\n%s", err, out)
+	}
+}
+
+func dropPrivilegesChild(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := dropPrivileges("nobody", ""); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getuid() == 0 || os.Getgid() == 0 {
+		t.Fatalf("still running as %d:%d", os.Getuid(), os.Getgid())
+	}
+	client, err := net.Dial("udp4", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 16)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil || string(b[:n]) != "query" {
+		t.Errorf("socket read %q, %v after dropping privileges", b[:n], err)
+	}
+}
+
+func TestDropPrivilegesUnknownUser(t *testing.T) {
+	if err := dropPrivileges("dcdns-no-such-user", ""); err == nil {
+		t.Error("dropped privileges to a user that doesn't exist")
+	}
+}
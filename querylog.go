@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// queryLog is a buffered log file that can be reopened, for logrotate to
+// move it away. The buffer is flushed every second.
+type queryLog struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func openQueryLog(path string) (*queryLog, error) {
+	l := &queryLog{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *queryLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	l.f, l.w = f, bufio.NewWriter(f)
+	return nil
+}
+
+func (l *queryLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// reopen flushes and closes the file, then opens path again. The old file is
+// kept if that fails.
+func (l *queryLog) reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Flush()
+	old := l.f
+	if err := l.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (l *queryLog) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Flush()
+}
+
+// flushEvery flushes every d until ctx is done.
+func (l *queryLog) flushEvery(ctx context.Context, d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			l.flush()
+		}
+	}
+}
+
+func (l *queryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Flush()
+	return l.f.Close()
+}
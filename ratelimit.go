@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per client ip, each refilled at rate tokens
+// per second up to burst.
+type rateLimiter struct {
+	rate, burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket of ip, reporting whether there was one.
+func (l *rateLimiter) allow(ip net.IP) bool {
+	now := time.Now()
+	key := ip.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if b.tokens += now.Sub(b.last).Seconds() * l.rate; b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets the clients whose bucket has filled up again, they're
+// indistinguishable from new ones.
+func (l *rateLimiter) sweep() {
+	now := time.Now()
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	l.mu.Lock()
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, k)
+		}
+	}
+	l.mu.Unlock()
+}
+
+// sweepEvery sweeps every d until ctx is done.
+func (l *rateLimiter) sweepEvery(ctx context.Context, d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			l.sweep()
+		}
+	}
+}
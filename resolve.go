@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolveFrom is the client resolve queries are answered for.
+var resolveFrom = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// rcodeNames are the rcodes as dig prints them.
+var rcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// resolveNames writes to w the rcode and records the server answers A and
+// AAAA queries for each of names with, for dcdns resolve. Names without one
+// of suffixes or a zone's get the first suffix. It returns the exit status:
+// 0 if all of them got NOERROR, 1 otherwise.
+func resolveNames(w io.Writer, s *server, suffixes []string, names []string) int {
+	if len(names) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: dcdns [flags] resolve name...")
+		return 2
+	}
+	status := 0
+	for _, name := range names {
+		fqdn := qualify(s, suffixes, name)
+		replies, err := resolveTypes(s, fqdn, dnsmessage.TypeA, dnsmessage.TypeAAAA)
+		if err != nil {
+			fmt.Fprintf(w, "%s: %v\n", fqdn, err)
+			status = 1
+			continue
+		}
+		// the worse of the two: nxdomain is the name's, servfail may be the
+		// lookup of one type's
+		rcode := replies[0].RCode
+		if rcode == dnsmessage.RCodeSuccess {
+			rcode = replies[1].RCode
+		}
+		if rcode != dnsmessage.RCodeSuccess {
+			status = 1
+		}
+		rc, ok := rcodeNames[rcode]
+		if !ok {
+			rc = strings.TrimPrefix(rcode.String(), "RCode")
+		}
+		fmt.Fprintf(w, "%s %s\n", fqdn, rc)
+		for i, r := range replies {
+			for _, a := range r.Answers {
+				// the aaaa reply repeats the cnames of the a one
+				if i > 0 && a.Header.Type != dnsmessage.TypeAAAA {
+					continue
+				}
+				if rr := formatAnswer(a); rr != "" {
+					fmt.Fprintf(w, "%s %s\n", a.Header.Name, rr)
+				}
+			}
+		}
+	}
+	return status
+}
+
+// qualify returns name as a fully qualified name, under the first of
+// suffixes unless it's under one of them, or a zone, already.
+func qualify(s *server, suffixes []string, name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if s.zoneOf(name) != nil {
+		return name + "."
+	}
+	lower := strings.ToLower(name)
+	for _, sf := range suffixes {
+		if lower == sf || strings.HasSuffix(lower, "."+sf) {
+			return name + "."
+		}
+	}
+	return name + "." + suffixes[0] + "."
+}
+
+// resolveTypes returns the replies the server gives to queries for fqdn of
+// each of qtypes.
+func resolveTypes(s *server, fqdn string, qtypes ...dnsmessage.Type) ([]*dnsmessage.Message, error) {
+	var replies []*dnsmessage.Message
+	for _, qtype := range qtypes {
+		r, err := resolveQuery(s, fqdn, qtype)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, r)
+	}
+	return replies, nil
+}
+
+// resolveQuery returns the reply the server gives to a qtype query for
+// fqdn.
+func resolveQuery(s *server, fqdn string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, err
+	}
+	m, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+	rb, err := s.handle(m, resolveFrom, false)
+	if err != nil {
+		return nil, err
+	}
+	var r dnsmessage.Message
+	if err := r.Unpack(rb); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// formatAnswer returns the type and data of an a, aaaa or cname record, ""
+// for others.
+func formatAnswer(a dnsmessage.Resource) string {
+	switch b := a.Body.(type) {
+	case *dnsmessage.AResource:
+		return "A " + net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return "AAAA " + net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return "CNAME " + b.CNAME.String()
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/heliorosa/dcdns/resolver"
+)
+
+// resolve prints what the server answers: hosts, cnames, the apex and zones
+// included, containers without addresses get NODATA.
+func TestResolveNames(t *testing.T) {
+	web := running("web", "172.17.0.2")
+	web.Labels = map[string]string{"dcdns.cname": "www"}
+	noaddr := running("noaddr", "")
+	cfg := resolver.Config{
+		Suffixes:   []string{"docker"},
+		TTL:        60,
+		Refresh:    time.Minute,
+		CNAMELabel: "dcdns.cname",
+		Hosts:      map[string][]net.IP{"gw": {net.IPv4(10, 0, 0, 1)}},
+	}
+	s := testServer(t)
+	s.res = resolver.New(listDocker{containers: []types.Container{web, noaddr}}, cfg)
+	zcfg := cfg
+	zcfg.Suffixes, zcfg.Hosts = []string{"prod.docker"}, map[string][]net.IP{"api": {net.IPv4(10, 0, 0, 2)}}
+	s.zones = []zone{{suffix: "prod.docker", res: resolver.New(listDocker{}, zcfg)}}
+
+	var out bytes.Buffer
+	status := resolveNames(&out, s, cfg.Suffixes, []string{"web", "WWW.docker.", "gw", "noaddr", "api.prod.docker", "docker", "nope"})
+	want := `web.docker. NOERROR
+web.docker. A 172.17.0.2
+WWW.docker. NOERROR
+WWW.docker. CNAME web.docker.
+web.docker. A 172.17.0.2
+gw.docker. NOERROR
+gw.docker. A 10.0.0.1
+noaddr.docker. NOERROR
+api.prod.docker. NOERROR
+api.prod.docker. A 10.0.0.2
+docker. NOERROR
+nope.docker. NXDOMAIN
+`
+	if got := out.String(); got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+	if status != 1 {
+		t.Errorf("status %d, want 1 for nope", status)
+	}
+}
@@ -0,0 +1,121 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+)
+
+type adminAddress struct {
+	Network string `json:"network"`
+	IPv4    string `json:"ipv4,omitempty"`
+	IPv6    string `json:"ipv6,omitempty"`
+}
+
+type adminName struct {
+	Name      string         `json:"name"`
+	ID        string         `json:"id"`
+	State     string         `json:"state"`
+	Addresses []adminAddress `json:"addresses"`
+}
+
+type adminCacheEntry struct {
+	Name    string `json:"name"`
+	ID      string `json:"id,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+	TTL     int    `json:"ttl"`
+}
+
+// AdminHandler serves a view of what the resolver would answer: GET /names
+// lists the containers with their state and addresses, GET /cache the cached
+// containers with their remaining ttl in seconds. POST /cache/flush empties
+// the cache and has the index rebuilt.
+func (res *Resolver) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/names", res.serveNames)
+	mux.HandleFunc("/cache", res.serveCache)
+	mux.HandleFunc("/cache/flush", res.serveCacheFlush)
+	return mux
+}
+
+func (res *Resolver) serveCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snap, now := res.cache.snapshot()
+	entries := make([]adminCacheEntry, 0, len(snap))
+	for name, e := range snap {
+		ce := adminCacheEntry{
+			Name:    name,
+			Missing: e.missing,
+			TTL:     int(math.Ceil(e.expires.Sub(now).Seconds())),
+		}
+		if e.info.ContainerJSONBase != nil {
+			ce.ID = e.info.ID
+		}
+		entries = append(entries, ce)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (res *Resolver) serveCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res.cache.flush()
+	res.services.flush()
+	res.invalidateIndex()
+	slog.Info("cache flushed", "client", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (res *Resolver) serveNames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), res.timeout)
+	defer cancel()
+	containers, err := res.cl.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: res.filter.args()})
+	if err != nil {
+		slog.Warn("can't list containers", "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	names := make([]adminName, 0, len(containers))
+	for _, c := range containers {
+		name := containerName(c)
+		if name == "" {
+			continue
+		}
+		n := adminName{
+			Name:      name,
+			ID:        c.ID,
+			State:     c.State,
+			Addresses: []adminAddress{},
+		}
+		if c.NetworkSettings != nil {
+			for net, netInfo := range c.NetworkSettings.Networks {
+				n.Addresses = append(n.Addresses, adminAddress{
+					Network: net,
+					IPv4:    netInfo.IPAddress,
+					IPv6:    netInfo.GlobalIPv6Address,
+				})
+			}
+		}
+		sort.Slice(n.Addresses, func(i, j int) bool { return n.Addresses[i].Network < n.Addresses[j].Network })
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Name < names[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
@@ -0,0 +1,135 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+type cacheEntry struct {
+	info    types.ContainerJSON
+	missing bool // docker said there's no such container
+	expires time.Time
+}
+
+// containerCache holds container inspect results keyed by lowercased name.
+// Entries live for ttl, names docker doesn't know about for negTTL; now is
+// the clock used for expiry.
+type containerCache struct {
+	ttl, negTTL time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newContainerCache(ttl, negTTL time.Duration, now func() time.Time) *containerCache {
+	return &containerCache{ttl: ttl, negTTL: negTTL, now: now, entries: make(map[string]cacheEntry)}
+}
+
+func (c *containerCache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !c.now().Before(e.expires) {
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *containerCache) set(key string, info types.ContainerJSON) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 {
+		return
+	}
+	c.entries[key] = cacheEntry{info: info, expires: c.now().Add(c.ttl)}
+}
+
+// setTTL changes the ttl of the entries set from now on.
+func (c *containerCache) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	c.ttl = ttl
+	c.mu.Unlock()
+}
+
+// setMissing remembers that docker doesn't know about key.
+func (c *containerCache) setMissing(key string) {
+	if c.negTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.entries[key] = cacheEntry{missing: true, expires: c.now().Add(c.negTTL)}
+	c.mu.Unlock()
+}
+
+// forgetMissing drops the negative entries, a new container may carry any
+// of those names.
+func (c *containerCache) forgetMissing() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.missing {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// snapshot returns a copy of the entries that haven't expired, along with
+// the time it was taken at.
+func (c *containerCache) snapshot() (map[string]cacheEntry, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	entries := make(map[string]cacheEntry, len(c.entries))
+	for k, e := range c.entries {
+		if now.Before(e.expires) {
+			entries[k] = e
+		}
+	}
+	return entries, now
+}
+
+// sweep evicts expired entries.
+func (c *containerCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *containerCache) sweepEvery(ctx context.Context, d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.sweep()
+		}
+	}
+}
+
+// evict removes every entry that refers to the container with the given ID.
+func (c *containerCache) evict(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.info.ContainerJSONBase != nil && e.info.ID == id {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *containerCache) flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]cacheEntry)
+	c.mu.Unlock()
+}
@@ -0,0 +1,65 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// fakeClock is a clock tests move forward by hand.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestCacheExpiry(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1e9, 0)}
+	c := newContainerCache(10*time.Second, 2*time.Second, clock.now)
+	c.set("web", types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: "aaaa1111"}})
+	c.setMissing("nope")
+
+	steps := []struct {
+		after          time.Duration
+		web, nope, neg bool
+	}{
+		{0, true, true, true},
+		{time.Second, true, true, true},
+		// the negative entry expires first
+		{time.Second, true, false, false},
+		{7 * time.Second, true, false, false},
+		{time.Second, false, false, false},
+	}
+	for i, s := range steps {
+		clock.advance(s.after)
+		if e, ok := c.get("web"); ok != s.web || ok && e.info.ID != "aaaa1111" {
+			t.Errorf("step %d: web cached %v, want %v", i, ok, s.web)
+		}
+		e, ok := c.get("nope")
+		if ok != s.nope || ok && !e.missing {
+			t.Errorf("step %d: nope cached %v, want %v", i, ok, s.nope)
+		}
+		snap, now := c.snapshot()
+		if _, neg := snap["nope"]; neg != s.neg || !now.Equal(clock.t) {
+			t.Errorf("step %d: snapshot has nope %v at %v, want %v at %v", i, neg, now, s.neg, clock.t)
+		}
+	}
+	c.sweep()
+	if snap, _ := c.snapshot(); len(snap) != 0 || len(c.entries) != 0 {
+		t.Errorf("%d entries left after sweeping, want none", len(c.entries))
+	}
+}
+
+// With no ttl, nothing is cached.
+func TestCacheDisabled(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1e9, 0)}
+	c := newContainerCache(0, 0, clock.now)
+	c.set("web", types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: "aaaa1111"}})
+	c.setMissing("nope")
+	if _, ok := c.get("web"); ok {
+		t.Error("web cached with a zero ttl")
+	}
+	if _, ok := c.get("nope"); ok {
+		t.Error("nope cached with a zero negative ttl")
+	}
+}
@@ -0,0 +1,62 @@
+package resolver
+
+import (
+	"log/slog"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxCNAMEChain bounds the cnames followed for a query, in case labels make
+// a loop.
+const maxCNAMEChain = 8
+
+// replyCNAME answers queries for names given by the cname label with the
+// chain of cnames leading to a container and, for address queries, the
+// container's addresses. ok is false if name isn't a cname.
+func (res *Resolver) replyCNAME(r *dnsmessage.Message, name, suffix string) (*dnsmessage.Message, bool, error) {
+	if res.index.cnameLabel == "" {
+		return r, false, nil
+	}
+	q := r.Questions[0]
+	owner := q.Name
+	var chain []dnsmessage.Resource
+	for {
+		target, ok, err := res.index.lookupCNAME(res.cl, name)
+		if err != nil {
+			r, err = lookupFailed(r, err)
+			return r, true, err
+		}
+		if !ok {
+			break
+		}
+		if len(chain) == maxCNAMEChain {
+			slog.Warn("cname chain too long", "name", q.Name.String())
+			r.RCode = dnsmessage.RCodeServerFailure
+			return r, true, nil
+		}
+		tn, err := dnsmessage.NewName(encodeName(target) + "." + suffix + ".")
+		if err != nil {
+			return nil, true, err
+		}
+		chain = append(chain, res.answer(owner, dnsmessage.TypeCNAME, &dnsmessage.CNAMEResource{CNAME: tn}))
+		owner, name = tn, target
+		if q.Type == dnsmessage.TypeCNAME {
+			break
+		}
+	}
+	if len(chain) == 0 {
+		return r, false, nil
+	}
+	r.RCode = dnsmessage.RCodeSuccess
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeALL:
+		var err error
+		if r, err = res.replyAddress(r, owner, name); err != nil {
+			return nil, true, err
+		}
+	default:
+		r.Answers = nil
+	}
+	r.Answers = append(chain, r.Answers...)
+	return r, true, nil
+}
@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dumpMessage logs the header, questions and EDNS0 options of m, and the
+// records of replies, at debug level.
+func dumpMessage(dir string, from net.Addr, m []byte) {
+	var r dnsmessage.Message
+	if err := r.Unpack(m); err != nil {
+		slog.Debug(dir, "client", from, "size", len(m), "err", err)
+		return
+	}
+	h := r.Header
+	attrs := []any{
+		"client", from,
+		"size", len(m),
+		"id", h.ID,
+		"opcode", h.OpCode,
+		"rcode", h.RCode,
+		"flags", headerFlags(h),
+	}
+	var qs []string
+	for _, q := range r.Questions {
+		qs = append(qs, fmt.Sprintf("%s %s %s", q.Name, q.Class, q.Type))
+	}
+	attrs = append(attrs, "questions", qs)
+	if h.Response {
+		attrs = append(attrs, "answers", records(r.Answers), "authorities", records(r.Authorities))
+	}
+	for _, a := range r.Additionals {
+		opt, ok := a.Body.(*dnsmessage.OPTResource)
+		if !ok {
+			continue
+		}
+		var codes []uint16
+		for _, o := range opt.Options {
+			codes = append(codes, o.Code)
+		}
+		attrs = append(attrs,
+			"edns_udp_size", a.Header.Class,
+			"edns_do", a.Header.DNSSECAllowed(),
+			"edns_options", codes,
+		)
+	}
+	slog.Debug(dir, attrs...)
+}
+
+func headerFlags(h dnsmessage.Header) string {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{h.Response, "qr"},
+		{h.Authoritative, "aa"},
+		{h.Truncated, "tc"},
+		{h.RecursionDesired, "rd"},
+		{h.RecursionAvailable, "ra"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return strings.Join(flags, " ")
+}
+
+func records(rrs []dnsmessage.Resource) []string {
+	var s []string
+	for _, rr := range rrs {
+		s = append(s, fmt.Sprintf("%s %d %s", rr.Header.Name, rr.Header.TTL, rr.Header.Type))
+	}
+	return s
+}
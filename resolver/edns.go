@@ -0,0 +1,64 @@
+package resolver
+
+import "golang.org/x/net/dns/dnsmessage"
+
+const (
+	// minUDPSize is the largest UDP reply every client accepts (RFC 1035).
+	minUDPSize = 512
+	// DefaultMaxUDPSize is the largest UDP payload advertised and accepted
+	// unless configured otherwise.
+	DefaultMaxUDPSize = 4096
+)
+
+// replyEDNS replaces the additional section of the query r with our OPT
+// record if the client sent one (RFC 6891) and returns the largest UDP reply
+// the client accepts, up to max.
+func replyEDNS(r *dnsmessage.Message, max int) (int, error) {
+	size := minUDPSize
+	var opt *dnsmessage.Resource
+	for i := range r.Additionals {
+		if r.Additionals[i].Header.Type == dnsmessage.TypeOPT {
+			opt = &r.Additionals[i]
+			break
+		}
+	}
+	r.Additionals = nil
+	if opt == nil {
+		return size, nil
+	}
+	// an OPT record carries the client's UDP payload size in its class
+	if s := int(opt.Header.Class); s > size {
+		size = s
+	}
+	if size > max {
+		size = max
+	}
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(max, dnsmessage.RCodeSuccess, false); err != nil {
+		return 0, err
+	}
+	r.Additionals = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}}
+	return size, nil
+}
+
+// truncate drops records from r until it packs into size bytes and sets the
+// TC bit so the client can retry over tcp for the full answer. The OPT
+// record is kept, answers go last so as many as fit are still returned.
+func truncate(r *dnsmessage.Message, size int) ([]byte, error) {
+	r.Truncated = true
+	r.Authorities = nil
+	var additionals []dnsmessage.Resource
+	for _, a := range r.Additionals {
+		if a.Header.Type == dnsmessage.TypeOPT {
+			additionals = append(additionals, a)
+		}
+	}
+	r.Additionals = additionals
+	for {
+		rb, err := r.Pack()
+		if err != nil || len(rb) <= size || len(r.Answers) == 0 {
+			return rb, err
+		}
+		r.Answers = r.Answers[:len(r.Answers)-1]
+	}
+}
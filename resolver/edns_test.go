@@ -0,0 +1,125 @@
+package resolver
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// packQueryEDNS packs a query for name advertising a UDP payload size of
+// size, none if 0, with the TC bit set if tc is.
+func packQueryEDNS(t *testing.T, name string, typ dnsmessage.Type, size int, tc bool) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234, RecursionDesired: true, Truncated: tc},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	if size > 0 {
+		var h dnsmessage.ResourceHeader
+		if err := h.SetEDNS0(size, dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+		m.Additionals = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}}
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// manyNetworks returns a container named name attached to n networks, with
+// an address on each.
+func manyNetworks(name string, n int) *fakeContainer {
+	var nets []netEndpoint
+	for i := 0; i < n; i++ {
+		nets = append(nets, ep(fmt.Sprintf("net%d", i), fmt.Sprintf("10.%d.%d.2", i/250, i%250), ""))
+	}
+	return ctr(name, "aaaa1111", nets...)
+}
+
+// Answers too large for the client's UDP payload size are cut to fit with
+// the TC bit set, over tcp they come whole.
+func TestTruncate(t *testing.T) {
+	res := New(newFakeDocker(manyNetworks("big", 100)), testConfig())
+	tests := []struct {
+		size  int // advertised, 0 for none
+		tcp   bool
+		limit int
+		tc    bool
+	}{
+		{0, false, minUDPSize, true},
+		// below the minimum every client accepts
+		{256, false, minUDPSize, true},
+		{1232, false, 1232, true},
+		{4096, false, 4096, false},
+		{0, true, 65535, false},
+		{1232, true, 65535, false},
+	}
+	for _, tt := range tests {
+		m := packQueryEDNS(t, "big.docker.", dnsmessage.TypeA, tt.size, false)
+		rb, err := res.Handle(m, clientAddr(tt.tcp), !tt.tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r dnsmessage.Message
+		if err := r.Unpack(rb); err != nil {
+			t.Fatal(err)
+		}
+		if len(rb) > tt.limit || r.Truncated != tt.tc {
+			t.Errorf("size %d, tcp %v: %d bytes with tc %v, want at most %d with tc %v", tt.size, tt.tcp, len(rb), r.Truncated, tt.limit, tt.tc)
+		}
+		if tt.tc && len(r.Answers) == 0 || !tt.tc && len(r.Answers) != 100 {
+			t.Errorf("size %d, tcp %v: %d answers", tt.size, tt.tcp, len(r.Answers))
+		}
+		if tt.size > 0 && (len(r.Additionals) != 1 || r.Additionals[0].Header.Type != dnsmessage.TypeOPT) {
+			t.Errorf("size %d, tcp %v: additionals %v, want the OPT record", tt.size, tt.tcp, r.Additionals)
+		}
+	}
+}
+
+// The TC bit of a query means nothing, replies that fit don't carry it.
+func TestTruncatedQuery(t *testing.T) {
+	res := New(newFakeDocker(ctr("web", "aaaa1111", ep("bridge", "172.17.0.2", ""))), testConfig())
+	for _, name := range []string{"web.docker.", "missing.docker.", "web.example."} {
+		r := handle(t, res, packQueryEDNS(t, name, dnsmessage.TypeA, 0, true), false)
+		if r.Truncated {
+			t.Errorf("%s: reply has the TC bit set", name)
+		}
+	}
+}
+
+// Nothing but the header and question fits, truncate still returns them.
+func TestTruncateNoRoom(t *testing.T) {
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+	name := dnsmessage.MustNewName("web.docker.")
+	r := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, Response: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+		}},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.NSResource{NS: name},
+		}},
+		Additionals: []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}},
+	}
+	rb, err := truncate(r, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got dnsmessage.Message
+	if err := got.Unpack(rb); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Truncated || len(got.Questions) != 1 || len(got.Answers) != 0 || len(got.Authorities) != 0 || len(got.Additionals) != 1 {
+		t.Errorf("tc %v with %d questions, %d answers, %d authorities and %d additionals, want tc, 1, 0, 0 and the OPT record",
+			got.Truncated, len(got.Questions), len(got.Answers), len(got.Authorities), len(got.Additionals))
+	}
+}
@@ -0,0 +1,120 @@
+package resolver
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// WatchEvents evicts cached containers as they change, reconnecting to the
+// events stream whenever it breaks (e.g. the docker daemon restarts).
+func (res *Resolver) WatchEvents(ctx context.Context) {
+	if res.warm != nil {
+		for i := 0; i < warmWorkers; i++ {
+			go res.warmStarted(ctx)
+		}
+	}
+	f := filters.NewArgs(
+		filters.Arg("type", events.ContainerEventType),
+		filters.Arg("type", events.NetworkEventType),
+		filters.Arg("event", "start"),
+		filters.Arg("event", "die"),
+		filters.Arg("event", "destroy"),
+		filters.Arg("event", "disconnect"),
+	)
+	for {
+		err := res.consumeEvents(ctx, f)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("docker events error", "err", err)
+		// events may have been missed while disconnected
+		res.cache.flush()
+		res.invalidateIndex()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (res *Resolver) consumeEvents(ctx context.Context, f filters.Args) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msgs, errs := res.cl.Events(ctx, types.EventsOptions{Filters: f})
+	for {
+		select {
+		case m := <-msgs:
+			id := m.Actor.ID
+			if m.Type == events.NetworkEventType {
+				id = m.Actor.Attributes["container"]
+			}
+			res.cache.evict(id)
+			if m.Action == "start" {
+				res.cache.forgetMissing()
+			}
+			res.invalidateIndex()
+			res.serial.bump()
+			if m.Action == "start" && m.Type == events.ContainerEventType {
+				res.warmUp(m.Actor.Attributes["name"])
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+// warmWorkers bound the inspects made to warm the cache, started
+// containers queued while they're all busy are dropped past warmQueue.
+const (
+	warmWorkers = 2
+	warmQueue   = 64
+)
+
+// warmUp queues the started container name to be looked up ahead of the
+// first query for it, if warming.
+func (res *Resolver) warmUp(name string) {
+	if res.warm == nil || name == "" {
+		return
+	}
+	select {
+	case res.warm <- name:
+	default:
+	}
+}
+
+// warmStarted inspects the queued containers into the cache and brings the
+// index up to date until ctx is done.
+func (res *Resolver) warmStarted(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case name := <-res.warm:
+			if _, err := res.inspectCached(name); err != nil {
+				slog.Debug("can't warm container", "name", name, "err", err)
+			}
+			if !res.prebuilt {
+				res.index.warm(res.cl)
+			}
+		}
+	}
+}
+
+// invalidateIndex has the index rebuilt: in the background when it's
+// prebuilt, on the next lookup otherwise.
+func (res *Resolver) invalidateIndex() {
+	if !res.prebuilt {
+		res.index.invalidate()
+		return
+	}
+	select {
+	case res.rebuild <- struct{}{}:
+	default:
+	}
+}
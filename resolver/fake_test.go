@@ -0,0 +1,277 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeContainer is a container known to fakeDocker.
+type fakeContainer struct {
+	name, id         string
+	stopped          bool
+	labels           map[string]string
+	nets             map[string]*network.EndpointSettings
+	hostname, domain string
+	ports            []string // exposed, like 80/tcp
+}
+
+// ctr returns a running container attached to nets.
+func ctr(name, id string, nets ...netEndpoint) *fakeContainer {
+	c := &fakeContainer{name: name, id: id, labels: map[string]string{}, nets: map[string]*network.EndpointSettings{}}
+	for _, n := range nets {
+		c.nets[n.network] = &network.EndpointSettings{NetworkID: n.network, IPAddress: n.v4, GlobalIPv6Address: n.v6, Aliases: n.aliases}
+	}
+	return c
+}
+
+type netEndpoint struct {
+	network, v4, v6 string
+	aliases         []string
+}
+
+func ep(network, v4, v6 string, aliases ...string) netEndpoint {
+	return netEndpoint{network: network, v4: v4, v6: v6, aliases: aliases}
+}
+
+func (c *fakeContainer) label(k, v string) *fakeContainer {
+	c.labels[k] = v
+	return c
+}
+
+func (c *fakeContainer) state() string {
+	if c.stopped {
+		return "exited"
+	}
+	return "running"
+}
+
+func (c *fakeContainer) inspect() types.ContainerJSON {
+	ports := nat.PortMap{}
+	for _, p := range c.ports {
+		ports[nat.Port(p)] = nil
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         c.id,
+			Name:       "/" + c.name,
+			State:      &types.ContainerState{Status: c.state(), Running: !c.stopped},
+			HostConfig: &container.HostConfig{},
+		},
+		Config: &container.Config{Image: "img/" + c.name, Labels: c.labels, Hostname: c.hostname, Domainname: c.domain},
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{Ports: ports},
+			Networks:            c.nets,
+		},
+	}
+}
+
+func (c *fakeContainer) listed() types.Container {
+	var ports []types.Port
+	for _, p := range c.ports {
+		port := nat.Port(p)
+		ports = append(ports, types.Port{PrivatePort: uint16(port.Int()), Type: port.Proto()})
+	}
+	return types.Container{
+		Ports:           ports,
+		ID:              c.id,
+		Names:           []string{"/" + c.name},
+		Image:           "img/" + c.name,
+		Labels:          c.labels,
+		State:           c.state(),
+		Status:          "Up 1 minute",
+		NetworkSettings: &types.SummaryNetworkSettings{Networks: c.nets},
+	}
+}
+
+// fakeDocker is a DockerClient answering from its containers, counting the
+// calls made. Errors queued in inspectErrs are returned by the next
+// inspects, ahead of looking the container up, serviceErr by every service
+// inspect.
+type fakeDocker struct {
+	mu              sync.Mutex
+	containers      []*fakeContainer
+	services        map[string]swarm.Service
+	networks        []types.NetworkResource
+	inspectErrs     []error
+	serviceErr      error
+	inspects        int
+	lists           int
+	serviceInspects int
+}
+
+func newFakeDocker(containers ...*fakeContainer) *fakeDocker {
+	return &fakeDocker{containers: containers}
+}
+
+func (f *fakeDocker) add(c *fakeContainer) {
+	f.mu.Lock()
+	f.containers = append(f.containers, c)
+	f.mu.Unlock()
+}
+
+func (f *fakeDocker) calls() (inspects, lists int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.inspects, f.lists
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, name string) (types.ContainerJSON, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inspects++
+	if len(f.inspectErrs) > 0 {
+		err := f.inspectErrs[0]
+		f.inspectErrs = f.inspectErrs[1:]
+		return types.ContainerJSON{}, err
+	}
+	var found []*fakeContainer
+	for _, c := range f.containers {
+		if c.name == name || c.id == name {
+			return c.inspect(), nil
+		}
+		if strings.HasPrefix(c.id, name) {
+			found = append(found, c)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("no such container: %s", name))
+	case 1:
+		return found[0].inspect(), nil
+	}
+	// what the client makes of the daemon's 400, it isn't an invalid parameter
+	return types.ContainerJSON{}, fmt.Errorf("Error response from daemon: Multiple IDs found with provided prefix: %s", name)
+}
+
+func (f *fakeDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+	var list []types.Container
+	for _, c := range f.containers {
+		if c.stopped && !options.All {
+			continue
+		}
+		if !matchesFilters(c, options) {
+			continue
+		}
+		list = append(list, c.listed())
+	}
+	return list, nil
+}
+
+// matchesFilters applies the label and id filters the resolver uses. Like
+// docker's, the id filter matches anywhere in the id.
+func matchesFilters(c *fakeContainer, options types.ContainerListOptions) bool {
+	for _, l := range options.Filters.Get("label") {
+		k, v, hasValue := strings.Cut(l, "=")
+		got, ok := c.labels[k]
+		if !ok || hasValue && got != v {
+			return false
+		}
+	}
+	for _, id := range options.Filters.Get("id") {
+		if !strings.Contains(c.id, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeDocker) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return make(chan events.Message), make(chan error)
+}
+
+func (f *fakeDocker) ServiceInspectWithRaw(ctx context.Context, serviceID string, opts types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.serviceInspects++
+	if f.serviceErr != nil {
+		return swarm.Service{}, nil, f.serviceErr
+	}
+	if svc, ok := f.services[serviceID]; ok {
+		return svc, nil, nil
+	}
+	return swarm.Service{}, nil, errdefs.NotFound(fmt.Errorf("service %s not found", serviceID))
+}
+
+func (f *fakeDocker) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]types.NetworkResource(nil), f.networks...), nil
+}
+
+func (f *fakeDocker) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, n := range f.networks {
+		if n.Name == networkID || n.ID == networkID {
+			return n, nil
+		}
+	}
+	return types.NetworkResource{}, errdefs.NotFound(fmt.Errorf("network %s not found", networkID))
+}
+
+// testConfig returns the settings tests start from: the docker suffix and a
+// 60s ttl.
+func testConfig() Config {
+	return Config{Suffixes: []string{"docker"}, TTL: 60, DockerTimeout: time.Second}
+}
+
+// query returns the unpacked reply of res to a query for name of type t.
+func query(t *testing.T, res *Resolver, name string, typ dnsmessage.Type) *dnsmessage.Message {
+	t.Helper()
+	r, err := res.Reply(packQuery(t, name, typ))
+	if err != nil {
+		t.Fatalf("%s %v: %v", name, typ, err)
+	}
+	return r
+}
+
+func packQuery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// answerIPs returns the addresses in the A and AAAA answers of r, in order.
+func answerIPs(r *dnsmessage.Message) []string {
+	var ips []string
+	for _, a := range r.Answers {
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(b.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(b.AAAA[:]).String())
+		}
+	}
+	return ips
+}
+
+func sortedIPs(r *dnsmessage.Message) []string {
+	ips := answerIPs(r)
+	sort.Strings(ips)
+	return ips
+}
@@ -0,0 +1,28 @@
+package resolver
+
+import (
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+)
+
+// labelFilter is Config.FilterLabel: key=value, or key for containers with
+// the label set to anything. Empty matches every container.
+type labelFilter string
+
+func (f labelFilter) match(labels map[string]string) bool {
+	if f == "" {
+		return true
+	}
+	key, value, hasValue := strings.Cut(string(f), "=")
+	v, ok := labels[key]
+	return ok && (!hasValue || v == value)
+}
+
+// args returns the list filters of args, with the label filter added.
+func (f labelFilter) args(args ...filters.KeyValuePair) filters.Args {
+	if f != "" {
+		args = append(args, filters.Arg("label", string(f)))
+	}
+	return filters.NewArgs(args...)
+}
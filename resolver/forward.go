@@ -0,0 +1,146 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const forwardTimeout = 2 * time.Second
+
+// outOfZone reports whether the query in m asks for a name that's neither
+// under one of the suffixes nor a reverse lookup. Only standard queries are
+// forwarded. Reverse lookups are once they miss, see reverseMiss.
+func (res *Resolver) outOfZone(m []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(m)
+	if err != nil || h.OpCode != 0 {
+		return false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return false
+	}
+	if q.Type == dnsmessage.TypePTR {
+		return false
+	}
+	cn := canonicalName(q.Name.String())
+	if _, ok := res.apex(cn); ok {
+		return false
+	}
+	_, _, ok := res.splitName(cn)
+	return !ok
+}
+
+// reverseMiss reports whether r answers a reverse lookup of an ip that isn't
+// a container's, which is left to the upstream server.
+func reverseMiss(r *dnsmessage.Message) bool {
+	return len(r.Questions) == 1 && r.Questions[0].Type == dnsmessage.TypePTR && r.RCode == dnsmessage.RCodeNameError
+}
+
+// forwardQuery relays m to the upstream server fwd and returns its reply.
+// Queries come in over udp, unless udp is false: replies truncated upstream
+// are then asked again over tcp, and those to udp queries are cut to the
+// size the client accepts, which upstream may not know to be below its own.
+// Upstream failures are answered with SERVFAIL.
+func (res *Resolver) forwardQuery(fwd string, m []byte, udp bool) ([]byte, error) {
+	rb, err := exchange("udp", fwd, m)
+	if err == nil && !udp && truncated(rb) {
+		rb, err = exchange("tcp", fwd, m)
+	}
+	if err != nil {
+		slog.Warn("forward error", "upstream", fwd, "err", err)
+		return serverFailure(m)
+	}
+	if !udp || len(rb) <= minUDPSize {
+		return rb, nil
+	}
+	var q dnsmessage.Message
+	if err = q.Unpack(m); err != nil {
+		return rb, nil
+	}
+	size, err := replyEDNS(&q, res.maxUDPSize)
+	if err != nil || len(rb) <= size {
+		return rb, nil
+	}
+	var r dnsmessage.Message
+	if err = r.Unpack(rb); err != nil {
+		slog.Warn("forward error", "upstream", fwd, "err", err)
+		return serverFailure(m)
+	}
+	return truncate(&r, size)
+}
+
+// truncated reports whether the TC bit of the message in m is set.
+func truncated(m []byte) bool {
+	return len(m) > 2 && m[2]&0x02 != 0
+}
+
+// exchange sends m to upstream over network, udp or tcp, and returns the
+// reply.
+func exchange(network, upstream string, m []byte) ([]byte, error) {
+	c, err := net.DialTimeout(network, upstream, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(forwardTimeout))
+	if network == "tcp" {
+		return exchangeTCP(c, m)
+	}
+	if _, err = c.Write(m); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 65535)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams not answering our query
+		if n >= 2 && b[0] == m[0] && b[1] == m[1] {
+			return b[:n], nil
+		}
+	}
+}
+
+// exchangeTCP sends m over the tcp connection c, length-prefixed, and reads
+// the reply.
+func exchangeTCP(c net.Conn, m []byte) ([]byte, error) {
+	b := make([]byte, 2, 2+len(m))
+	binary.BigEndian.PutUint16(b, uint16(len(m)))
+	if _, err := c.Write(append(b, m...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	rb := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(c, rb); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
+
+// serverFailure builds a SERVFAIL reply to the query in m.
+func serverFailure(m []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(m)
+	if err != nil {
+		return nil, err
+	}
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	h.Response = true
+	h.Truncated = false
+	h.RecursionAvailable = false
+	h.RCode = dnsmessage.RCodeServerFailure
+	r := dnsmessage.Message{Header: h, Questions: qs}
+	return r.Pack()
+}
@@ -0,0 +1,196 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUpstream serves dns over udp and tcp on a loopback port, replying to
+// the queries with answer. It returns the address, the servers stop with
+// the test.
+func fakeUpstream(t *testing.T, answer func(q *dnsmessage.Message, tcp bool)) string {
+	t.Helper()
+	var (
+		pc  net.PacketConn
+		ln  net.Listener
+		err error
+	)
+	// the tcp port needs to be free too
+	for i := 0; i < 10; i++ {
+		if pc, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if ln, err = net.Listen("tcp4", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+	reply := func(m []byte, tcp bool) []byte {
+		var q dnsmessage.Message
+		if err := q.Unpack(m); err != nil {
+			return nil
+		}
+		q.Response = true
+		answer(&q, tcp)
+		rb, err := q.Pack()
+		if err != nil {
+			t.Error(err)
+		}
+		return rb
+	}
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(reply(b[:n], false), addr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var l [2]byte
+			if _, err := io.ReadFull(c, l[:]); err == nil {
+				m := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(c, m); err == nil {
+					rb := reply(m, true)
+					binary.BigEndian.PutUint16(l[:], uint16(len(rb)))
+					c.Write(append(l[:], rb...))
+				}
+			}
+			c.Close()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// upstreamPTR answers reverse lookups with upstream.example.
+func upstreamPTR(q *dnsmessage.Message, tcp bool) {
+	q.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("upstream.example.")},
+	}}
+}
+
+// clientAddr returns the address of a loopback client, over tcp if tcp is
+// set.
+func clientAddr(tcp bool) net.Addr {
+	if tcp {
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+// handle returns the unpacked reply Handle gives to the query m, sent over
+// udp unless tcp is set.
+func handle(t *testing.T, res *Resolver, m []byte, tcp bool) *dnsmessage.Message {
+	t.Helper()
+	rb, err := res.Handle(m, clientAddr(tcp), !tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r dnsmessage.Message
+	if err := r.Unpack(rb); err != nil {
+		t.Fatal(err)
+	}
+	return &r
+}
+
+func TestForwardReverseMiss(t *testing.T) {
+	fake := newFakeDocker(ctr("web", "aaaa1111", ep("bridge", "172.17.0.2", "fd00::2")))
+	cfg := testConfig()
+	cfg.Forward = fakeUpstream(t, upstreamPTR)
+	res := New(fake, cfg)
+	tests := []struct{ name, ptr string }{
+		{"2.0.17.172.in-addr.arpa.", "web.docker."},
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", "web.docker."},
+		{"8.8.8.8.in-addr.arpa.", "upstream.example."},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", "upstream.example."},
+	}
+	for _, tt := range tests {
+		r := handle(t, res, packQuery(t, tt.name, dnsmessage.TypePTR), false)
+		if r.RCode != dnsmessage.RCodeSuccess || len(r.Answers) != 1 {
+			t.Errorf("%s: rcode %v, %d answers", tt.name, r.RCode, len(r.Answers))
+			continue
+		}
+		if got := r.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String(); got != tt.ptr {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.ptr)
+		}
+	}
+}
+
+// upstreamMany answers with 100 addresses, over udp truncated to none if
+// tc is set.
+func upstreamMany(tc bool) func(q *dnsmessage.Message, tcp bool) {
+	return func(q *dnsmessage.Message, tcp bool) {
+		q.Additionals = nil
+		if tc && !tcp {
+			q.Truncated = true
+			return
+		}
+		for i := 0; i < 100; i++ {
+			q.Answers = append(q.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{10, 0, byte(i), 1}},
+			})
+		}
+	}
+}
+
+// Forwarded replies are cut to the client's UDP payload size, which
+// upstream may not know, and asked again over tcp when upstream truncated
+// them for a tcp client.
+func TestForwardTruncate(t *testing.T) {
+	tests := []struct {
+		upstreamTC bool
+		size       int
+		tcp        bool
+		limit      int
+		tc         bool
+		answers    int
+	}{
+		{false, 0, false, minUDPSize, true, -1},
+		{false, 1232, false, 1232, true, -1},
+		{false, 4096, false, 4096, false, 100},
+		{false, 0, true, 65535, false, 100},
+		// the tc bit of upstream goes through to udp clients, tcp ones
+		// get the full answer
+		{true, 0, false, minUDPSize, true, 0},
+		{true, 0, true, 65535, false, 100},
+	}
+	for _, tt := range tests {
+		cfg := testConfig()
+		cfg.Forward = fakeUpstream(t, upstreamMany(tt.upstreamTC))
+		res := New(newFakeDocker(), cfg)
+		rb, err := res.Handle(packQueryEDNS(t, "big.example.", dnsmessage.TypeA, tt.size, false), clientAddr(tt.tcp), !tt.tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r dnsmessage.Message
+		if err := r.Unpack(rb); err != nil {
+			t.Fatal(err)
+		}
+		if len(rb) > tt.limit || r.Truncated != tt.tc {
+			t.Errorf("%+v: %d bytes with tc %v", tt, len(rb), r.Truncated)
+		}
+		if tt.answers >= 0 && len(r.Answers) != tt.answers || tt.answers < 0 && len(r.Answers) == 0 {
+			t.Errorf("%+v: %d answers", tt, len(r.Answers))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package resolver
+
+import (
+	"context"
+	"net"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultBridgeOption marks the network docker attaches containers to by
+// default, whatever it's named.
+const defaultBridgeOption = "com.docker.network.bridge.default_bridge"
+
+// replyGateway answers queries for Config.GatewayName with the gateway of
+// the bridge network, the address containers reach the docker host at. ok
+// is false if name isn't the gateway name.
+func (res *Resolver) replyGateway(r *dnsmessage.Message, name string) (*dnsmessage.Message, bool, error) {
+	if res.gatewayName == "" || name != res.gatewayName {
+		return r, false, nil
+	}
+	ips, err := res.gatewayIPs()
+	if err != nil {
+		r, err = lookupFailed(r, err)
+		return r, true, err
+	}
+	return res.replyIPs(r, ips), true, nil
+}
+
+// gatewayIPs returns the gateways of Config.GatewayNetwork, or of the
+// default bridge if that's empty.
+func (res *Resolver) gatewayIPs() ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), res.timeout)
+	defer cancel()
+	opts := types.NetworkListOptions{Filters: filters.NewArgs(filters.Arg("driver", "bridge"))}
+	if res.gatewayNetwork != "" {
+		opts.Filters.Add("name", res.gatewayNetwork)
+	}
+	nets, err := res.cl.NetworkList(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nets {
+		if res.gatewayNetwork == "" && n.Options[defaultBridgeOption] != "true" {
+			continue
+		}
+		// the name filter matches substrings
+		if res.gatewayNetwork != "" && n.Name != res.gatewayNetwork {
+			continue
+		}
+		var ips []net.IP
+		for _, c := range n.IPAM.Config {
+			if ip := net.ParseIP(c.Gateway); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, nil
+	}
+	return nil, errNotFound(res.gatewayName)
+}
@@ -0,0 +1,42 @@
+package resolver
+
+import (
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// replyHost answers queries for the names given in Config.Hosts, ahead of
+// any container. ok is false if name isn't one of them.
+func (res *Resolver) replyHost(r *dnsmessage.Message, name string) (*dnsmessage.Message, bool) {
+	ips, ok := res.hosts[name]
+	if !ok {
+		return r, false
+	}
+	return res.replyIPs(r, ips), true
+}
+
+// replyIPs answers address queries with the ips of the queried family.
+func (res *Resolver) replyIPs(r *dnsmessage.Message, ips []net.IP) *dnsmessage.Message {
+	r.RCode = dnsmessage.RCodeSuccess
+	r.Answers = res.addressRecords(r.Questions[0], ips)
+	return r
+}
+
+// addressRecords returns the A or AAAA records, or both for ANY, owned by
+// q.Name for those of ips of the family q asks for.
+func (res *Resolver) addressRecords(q dnsmessage.Question, ips []net.IP) []dnsmessage.Resource {
+	var rrs []dnsmessage.Resource
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL) {
+			var a [4]byte
+			copy(a[:], ip4)
+			rrs = append(rrs, res.answer(q.Name, dnsmessage.TypeA, &dnsmessage.AResource{A: a}))
+		} else if ip4 == nil && (q.Type == dnsmessage.TypeAAAA || q.Type == dnsmessage.TypeALL) {
+			var a [16]byte
+			copy(a[:], ip)
+			rrs = append(rrs, res.answer(q.Name, dnsmessage.TypeAAAA, &dnsmessage.AAAAResource{AAAA: a}))
+		}
+	}
+	return rrs
+}
@@ -0,0 +1,408 @@
+package resolver
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+)
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+
+	// shortIDLen is the length of the container ids docker shows
+	shortIDLen = 12
+)
+
+// containerIndex holds the names that are only found by listing the
+// running containers. It maps:
+//
+//   - container ips to container names, for reverse lookups
+//   - network aliases to the endpoints carrying them
+//   - names and aliases qualified by a network (web.mynet) to their
+//     endpoint on it
+//   - names given by the nameLabel label, values of the valueLabel label,
+//     compose services and hostnames to their containers
+//   - names given by the cnameLabel label to the container names they're
+//     aliases of
+//   - container names and ids to the containers, for the prebuilt index
+//
+// It's rebuilt at most once per maxAge. Only containers matching filter
+// are indexed.
+type containerIndex struct {
+	maxAge     time.Duration
+	timeout    time.Duration
+	nameLabel  string
+	cnameLabel string
+	valueLabel string // the label values of which are names too
+	filter     labelFilter
+	hostnames  bool // inspect the containers for their hostnames
+
+	mu      sync.Mutex
+	m       *indexMaps // nil until built or once invalidated
+	updated time.Time
+
+	// a container's hostname doesn't change, it's inspected for once
+	hmu   sync.Mutex
+	hosts map[string][]string // keyed by id, of the last build's containers
+}
+
+type indexMaps struct {
+	names      map[string]string
+	aliases    map[string]endpoint
+	scoped     map[string]endpoint // keyed by name.network
+	labels     map[string][]types.Container
+	compose    map[string][]types.Container // keyed by service.project
+	hostnames  map[string][]types.Container
+	values     map[string][]types.Container // keyed by value of valueLabel
+	cnames     map[string]string
+	containers map[string]types.Container // keyed by name, id and short id
+}
+
+func newContainerIndex(maxAge, timeout time.Duration, nameLabel, cnameLabel, valueLabel string, filter labelFilter, hostnames bool) *containerIndex {
+	return &containerIndex{
+		maxAge:     maxAge,
+		timeout:    timeout,
+		nameLabel:  nameLabel,
+		cnameLabel: cnameLabel,
+		valueLabel: valueLabel,
+		filter:     filter,
+		hostnames:  hostnames,
+	}
+}
+
+// refresh rebuilds the index if it's too old, x.mu must be held.
+func (x *containerIndex) refresh(cl DockerClient) error {
+	if x.m != nil && time.Since(x.updated) <= x.maxAge {
+		return nil
+	}
+	m, err := x.build(cl)
+	if err != nil {
+		return err
+	}
+	x.m, x.updated = m, time.Now()
+	return nil
+}
+
+// rebuild rebuilds the index, lookups keep using the old one meanwhile.
+func (x *containerIndex) rebuild(cl DockerClient) error {
+	m, err := x.build(cl)
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	x.m, x.updated = m, time.Now()
+	x.mu.Unlock()
+	return nil
+}
+
+func (x *containerIndex) build(cl DockerClient) (*indexMaps, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), x.timeout)
+	defer cancel()
+	list, err := cl.ContainerList(ctx, types.ContainerListOptions{Filters: x.filter.args()})
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	aliases := make(map[string]endpoint)
+	scoped := make(map[string]endpoint)
+	labels := make(map[string][]types.Container)
+	compose := make(map[string][]types.Container)
+	hostnames := make(map[string][]types.Container)
+	values := make(map[string][]types.Container)
+	cnames := make(map[string]string)
+	containers := make(map[string]types.Container)
+	var hosts map[string][]string
+	if x.hostnames {
+		hosts = x.containerHostnames(cl, list)
+	}
+	for _, c := range list {
+		name := containerName(c)
+		if name == "" || c.NetworkSettings == nil {
+			continue
+		}
+		if n := c.Labels[x.nameLabel]; n != "" && x.nameLabel != "" {
+			key := strings.ToLower(n)
+			labels[key] = append(labels[key], c)
+		}
+		if v := c.Labels[x.valueLabel]; v != "" && x.valueLabel != "" {
+			key := strings.ToLower(v)
+			values[key] = append(values[key], c)
+		}
+		containers[strings.ToLower(name)] = c
+		containers[c.ID] = c
+		if len(c.ID) > shortIDLen {
+			containers[c.ID[:shortIDLen]] = c
+		}
+		if x.cnameLabel != "" {
+			for _, alias := range strings.Split(c.Labels[x.cnameLabel], ",") {
+				if alias = strings.ToLower(strings.TrimSpace(alias)); alias != "" {
+					cnames[alias] = name
+				}
+			}
+		}
+		project, service := c.Labels[composeProjectLabel], c.Labels[composeServiceLabel]
+		if project != "" && service != "" {
+			key := strings.ToLower(service + "." + project)
+			compose[key] = append(compose[key], c)
+		}
+		for _, h := range hosts[c.ID] {
+			hostnames[h] = append(hostnames[h], c)
+		}
+		for netName, netInfo := range c.NetworkSettings.Networks {
+			netName = strings.ToLower(netName)
+			scoped[strings.ToLower(name)+"."+netName] = endpoint{c, netInfo}
+			if ip := net.ParseIP(netInfo.IPAddress); ip != nil {
+				names[ip.String()] = name
+			}
+			if ip := net.ParseIP(netInfo.GlobalIPv6Address); ip != nil {
+				names[ip.String()] = name
+			}
+			for _, alias := range netInfo.Aliases {
+				aliases[strings.ToLower(alias)] = endpoint{c, netInfo}
+				scoped[strings.ToLower(alias)+"."+netName] = endpoint{c, netInfo}
+			}
+		}
+	}
+	for _, m := range []map[string][]types.Container{labels, compose, hostnames, values} {
+		for _, cs := range m {
+			sort.Slice(cs, func(i, j int) bool { return containerName(cs[i]) < containerName(cs[j]) })
+		}
+	}
+	// container names can't be shadowed
+	for alias := range cnames {
+		if _, ok := containers[alias]; ok {
+			delete(cnames, alias)
+		}
+	}
+	return &indexMaps{
+		names:      names,
+		aliases:    aliases,
+		scoped:     scoped,
+		labels:     labels,
+		compose:    compose,
+		hostnames:  hostnames,
+		values:     values,
+		cnames:     cnames,
+		containers: containers,
+	}, nil
+}
+
+// containerHostnames returns the hostnames of the listed containers by id,
+// inspecting only those the previous build didn't know. Those gone since
+// are forgotten, containers that fail to be inspected are tried again on
+// the next build.
+func (x *containerIndex) containerHostnames(cl DockerClient, list []types.Container) map[string][]string {
+	x.hmu.Lock()
+	defer x.hmu.Unlock()
+	hosts := make(map[string][]string, len(list))
+	for _, c := range list {
+		if h, ok := x.hosts[c.ID]; ok {
+			hosts[c.ID] = h
+		} else if h, err := x.inspectHostnames(cl, c.ID); err == nil {
+			hosts[c.ID] = h
+		}
+	}
+	x.hosts = hosts
+	return hosts
+}
+
+// inspectHostnames returns the lowercased hostname the container was started
+// with and, if it has a domain name, its fully qualified hostname. They're
+// only known by inspecting the container, one request per new container, so
+// it's opt-in.
+func (x *containerIndex) inspectHostnames(cl DockerClient, id string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), x.timeout)
+	defer cancel()
+	info, err := cl.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if info.Config == nil || info.Config.Hostname == "" {
+		return nil, nil
+	}
+	h := strings.ToLower(info.Config.Hostname)
+	if d := strings.Trim(strings.ToLower(info.Config.Domainname), "."); d != "" {
+		return []string{h, h + "." + d}, nil
+	}
+	return []string{h}, nil
+}
+
+// containerName returns the name of c without the leading slash the API
+// puts on names. Names of links (/other/alias) that containers on the legacy
+// bridge also get are skipped.
+func containerName(c types.Container) string {
+	for _, n := range c.Names {
+		if n = strings.TrimPrefix(n, "/"); n != "" && !strings.Contains(n, "/") {
+			return n
+		}
+	}
+	return ""
+}
+
+// lookupIP returns the name of the container owning ip.
+func (x *containerIndex) lookupIP(cl DockerClient, ip net.IP) (string, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return "", false, err
+	}
+	name, ok := x.m.names[ip.String()]
+	return name, ok, nil
+}
+
+// endpoint is a container's endpoint on one network.
+type endpoint struct {
+	c   types.Container
+	net *network.EndpointSettings
+}
+
+func (e endpoint) match() match {
+	return match{nets: []*network.EndpointSettings{e.net}, containers: []found{listedContainer(e.c)}}
+}
+
+// lookupAlias returns the endpoint of the network the alias is defined on.
+func (x *containerIndex) lookupAlias(cl DockerClient, alias string) (endpoint, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return endpoint{}, false, err
+	}
+	e, ok := x.m.aliases[strings.ToLower(alias)]
+	return e, ok, nil
+}
+
+// lookupScoped returns the endpoint on network of the container or alias
+// named by name, given as name.network.
+func (x *containerIndex) lookupScoped(cl DockerClient, name string) (endpoint, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return endpoint{}, false, err
+	}
+	e, ok := x.m.scoped[strings.ToLower(name)]
+	return e, ok, nil
+}
+
+// lookupLabel returns the containers named name by their label.
+func (x *containerIndex) lookupLabel(cl DockerClient, name string) ([]types.Container, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return nil, err
+	}
+	return x.m.labels[strings.ToLower(name)], nil
+}
+
+// lookupService returns the containers of a compose service, named
+// service.project.
+func (x *containerIndex) lookupService(cl DockerClient, name string) ([]types.Container, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return nil, err
+	}
+	return x.m.compose[strings.ToLower(name)], nil
+}
+
+// lookupValue returns the containers with the value label set to value.
+func (x *containerIndex) lookupValue(cl DockerClient, value string) ([]types.Container, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return nil, err
+	}
+	return x.m.values[strings.ToLower(value)], nil
+}
+
+// lookupHostname returns the containers whose configured hostname is name.
+func (x *containerIndex) lookupHostname(cl DockerClient, name string) ([]types.Container, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return nil, err
+	}
+	return x.m.hostnames[strings.ToLower(name)], nil
+}
+
+// lookupCNAME returns the name of the container alias is a cname for.
+func (x *containerIndex) lookupCNAME(cl DockerClient, alias string) (string, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return "", false, err
+	}
+	name, ok := x.m.cnames[strings.ToLower(alias)]
+	return name, ok, nil
+}
+
+// lookupContainer returns the running container named name, or with name
+// as its id or short id.
+func (x *containerIndex) lookupContainer(cl DockerClient, name string) (types.Container, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return types.Container{}, false, err
+	}
+	c, ok := x.m.containers[strings.ToLower(name)]
+	return c, ok, nil
+}
+
+// lookupIDPrefix returns the containers whose id starts with prefix.
+func (x *containerIndex) lookupIDPrefix(cl DockerClient, prefix string) ([]types.Container, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return nil, err
+	}
+	var matched []types.Container
+	for key, c := range x.m.containers {
+		// each container once, under its id
+		if key == c.ID && strings.HasPrefix(c.ID, prefix) {
+			matched = append(matched, c)
+		}
+	}
+	return matched, nil
+}
+
+// lookupSubstring returns the running containers whose name contains s.
+func (x *containerIndex) lookupSubstring(cl DockerClient, s string) ([]types.Container, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		return nil, err
+	}
+	s = strings.ToLower(s)
+	var containers []types.Container
+	for key, c := range x.m.containers {
+		// skip the id keys
+		if key == strings.ToLower(containerName(c)) && strings.Contains(key, s) {
+			containers = append(containers, c)
+		}
+	}
+	sort.Slice(containers, func(i, j int) bool { return containerName(containers[i]) < containerName(containers[j]) })
+	return containers, nil
+}
+
+// warm builds the index if it's missing or too old.
+func (x *containerIndex) warm(cl DockerClient) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.refresh(cl); err != nil {
+		slog.Debug("can't warm index", "err", err)
+	}
+}
+
+// invalidate forces a rebuild on the next lookup.
+func (x *containerIndex) invalidate() {
+	x.mu.Lock()
+	x.m = nil
+	x.mu.Unlock()
+}
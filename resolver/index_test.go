@@ -0,0 +1,128 @@
+package resolver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Building the index lists the containers once, it only inspects them when
+// hostnames are enabled.
+func TestIndexHostnames(t *testing.T) {
+	containers := func() []*fakeContainer {
+		web := ctr("web", "aaaa1111", ep("bridge", "172.17.0.2", ""))
+		web.hostname = "app"
+		return []*fakeContainer{
+			web,
+			ctr("db", "bbbb2222", ep("bridge", "172.17.0.3", "")),
+			ctr("cache", "cccc3333", ep("bridge", "172.17.0.4", "")),
+		}
+	}
+	tests := []struct {
+		hostnames bool
+		rcode     dnsmessage.RCode
+		inspects  int
+	}{
+		// the name is inspected, then looked up in the index
+		{false, dnsmessage.RCodeNameError, 1},
+		{true, dnsmessage.RCodeSuccess, 1 + 3},
+	}
+	for _, tt := range tests {
+		fake := newFakeDocker(containers()...)
+		cfg := testConfig()
+		cfg.Hostnames = tt.hostnames
+		r := query(t, New(fake, cfg), "app.docker.", dnsmessage.TypeA)
+		inspects, lists := fake.calls()
+		if r.RCode != tt.rcode {
+			t.Errorf("hostnames %v: rcode %v, want %v", tt.hostnames, r.RCode, tt.rcode)
+		}
+		if inspects != tt.inspects || lists != 1 {
+			t.Errorf("hostnames %v: %d inspects and %d lists, want %d and 1", tt.hostnames, inspects, lists, tt.inspects)
+		}
+	}
+}
+
+// Rebuilds only inspect the containers started since, and forget those gone.
+func TestIndexHostnamesCached(t *testing.T) {
+	fake := newFakeDocker(
+		ctr("web", "aaaa1111", ep("bridge", "172.17.0.2", "")),
+		ctr("db", "bbbb2222", ep("bridge", "172.17.0.3", "")),
+	)
+	fake.inspectErrs = []error{errors.New("timeout")}
+	x := newContainerIndex(time.Minute, time.Second, "", "", "", labelFilter(""), true)
+	steps := []struct {
+		change   func()
+		inspects int // in total
+		hosts    int
+	}{
+		// web fails to be inspected, it's tried again
+		{func() {}, 2, 1},
+		{func() {}, 3, 2},
+		{func() {}, 3, 2},
+		{func() {
+			fake.mu.Lock()
+			fake.containers = fake.containers[1:]
+			fake.mu.Unlock()
+			fake.add(ctr("cache", "cccc3333", ep("bridge", "172.17.0.4", "")))
+		}, 4, 2},
+	}
+	for i, s := range steps {
+		s.change()
+		if err := x.rebuild(fake); err != nil {
+			t.Fatal(err)
+		}
+		if inspects, _ := fake.calls(); inspects != s.inspects || len(x.hosts) != s.hosts {
+			t.Errorf("build %d: %d inspects and %d hostnames cached, want %d and %d", i+1, inspects, len(x.hosts), s.inspects, s.hosts)
+		}
+	}
+	if _, ok := x.hosts["aaaa1111"]; ok {
+		t.Error("removed container still cached")
+	}
+}
+
+func TestContainerName(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"/web"}, "web"},
+		{[]string{"web"}, "web"},
+		// links on the legacy bridge
+		{[]string{"/db/web", "/web"}, "web"},
+		{[]string{"/db/web"}, ""},
+		{[]string{"/"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := containerName(types.Container{Names: tt.names}); got != tt.want {
+			t.Errorf("%q: %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
+
+// Names built from the container list, where the API puts a slash ahead of
+// each, come out without it.
+func TestIndexNamesWithoutSlash(t *testing.T) {
+	fake := newFakeDocker(ctr("web", "aaaa1111", ep("front", "172.18.0.2", "", "webalias")))
+	res := New(fake, testConfig())
+	if got := fake.containers[0].listed().Names[0]; got != "/web" {
+		t.Fatalf("listed as %q, want /web", got)
+	}
+	r := query(t, res, "2.0.18.172.in-addr.arpa.", dnsmessage.TypePTR)
+	if len(r.Answers) != 1 {
+		t.Fatalf("ptr: rcode %v, %d answers, want one", r.RCode, len(r.Answers))
+	}
+	if got := r.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String(); got != "web.docker." {
+		t.Errorf("ptr %s, want web.docker.", got)
+	}
+	e, ok, err := res.index.lookupAlias(fake, "webalias")
+	if err != nil || !ok {
+		t.Fatalf("alias: found %v, %v", ok, err)
+	}
+	if got := containerName(e.c); got != "web" {
+		t.Errorf("alias of %q, want web", got)
+	}
+}
@@ -0,0 +1,132 @@
+package resolver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var inspectBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// Metrics counts queries and docker lookups, it's served in the prometheus
+// text format.
+type Metrics struct {
+	queries, nxdomain, servfail uint64
+	cacheHits, cacheMisses      uint64
+
+	mu          sync.Mutex
+	byType      map[string]uint64
+	inspectHist []uint64 // one per bucket plus +Inf
+	inspectSum  float64
+	inspectN    uint64
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		byType:      make(map[string]uint64),
+		inspectHist: make([]uint64, len(inspectBuckets)+1),
+	}
+}
+
+func (m *Metrics) query(msg []byte) {
+	atomic.AddUint64(&m.queries, 1)
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	q, err := p.Question()
+	if err != nil {
+		return
+	}
+	t := strings.TrimPrefix(q.Type.String(), "Type")
+	m.mu.Lock()
+	m.byType[t]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) reply(rb []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(rb)
+	if err != nil {
+		return
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeNameError:
+		atomic.AddUint64(&m.nxdomain, 1)
+	case dnsmessage.RCodeServerFailure:
+		atomic.AddUint64(&m.servfail, 1)
+	}
+}
+
+func (m *Metrics) cache(hit bool) {
+	if hit {
+		atomic.AddUint64(&m.cacheHits, 1)
+	} else {
+		atomic.AddUint64(&m.cacheMisses, 1)
+	}
+}
+
+func (m *Metrics) inspect(d time.Duration) {
+	sec := d.Seconds()
+	i := sort.SearchFloat64s(inspectBuckets, sec)
+	m.mu.Lock()
+	m.inspectHist[i]++
+	m.inspectSum += sec
+	m.inspectN++
+	m.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("dcdns_queries_total", "DNS queries received.", atomic.LoadUint64(&m.queries))
+	counter("dcdns_nxdomain_total", "NXDOMAIN replies sent.", atomic.LoadUint64(&m.nxdomain))
+	counter("dcdns_servfail_total", "SERVFAIL replies sent.", atomic.LoadUint64(&m.servfail))
+	counter("dcdns_cache_hits_total", "Container lookups served from the cache.", atomic.LoadUint64(&m.cacheHits))
+	counter("dcdns_cache_misses_total", "Container lookups sent to docker.", atomic.LoadUint64(&m.cacheMisses))
+
+	m.mu.Lock()
+	types := make([]string, 0, len(m.byType))
+	for t := range m.byType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	b.WriteString("# HELP dcdns_queries_by_type_total DNS queries received by question type.\n")
+	b.WriteString("# TYPE dcdns_queries_by_type_total counter\n")
+	for _, t := range types {
+		fmt.Fprintf(&b, "dcdns_queries_by_type_total{type=%q} %d\n", t, m.byType[t])
+	}
+	b.WriteString("# HELP dcdns_docker_inspect_duration_seconds Latency of docker container inspects.\n")
+	b.WriteString("# TYPE dcdns_docker_inspect_duration_seconds histogram\n")
+	var cum uint64
+	for i, n := range m.inspectHist {
+		cum += n
+		le := "+Inf"
+		if i < len(inspectBuckets) {
+			le = fmt.Sprint(inspectBuckets[i])
+		}
+		fmt.Fprintf(&b, "dcdns_docker_inspect_duration_seconds_bucket{le=%q} %d\n", le, cum)
+	}
+	fmt.Fprintf(&b, "dcdns_docker_inspect_duration_seconds_sum %g\n", m.inspectSum)
+	fmt.Fprintf(&b, "dcdns_docker_inspect_duration_seconds_count %d\n", m.inspectN)
+	m.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,83 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// netZone is the label of the sub-zone naming docker networks, with
+// Config.NetZone: mynet.net.docker. for the network mynet.
+const netZone = "net"
+
+// replyNetwork answers queries for <network>.net with the network's
+// gateways in A and AAAA records and its address pools in TXT ones, a
+// subnet=<cidr> and a gateway=<ip> record (RFC 1464) each. Other types get
+// NODATA. ok is false if name isn't in the sub-zone.
+func (res *Resolver) replyNetwork(r *dnsmessage.Message, name string) (*dnsmessage.Message, bool, error) {
+	network, found := strings.CutSuffix(name, "."+netZone)
+	if !res.netZone || !found || network == "" {
+		return r, false, nil
+	}
+	n, err := res.inspectNetwork(network)
+	if err != nil {
+		r, err = lookupFailed(r, err)
+		return r, true, err
+	}
+	q := r.Questions[0]
+	r.RCode = dnsmessage.RCodeSuccess
+	r.Answers = nil
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeALL:
+		var ips []net.IP
+		for _, c := range n.IPAM.Config {
+			if ip := net.ParseIP(c.Gateway); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return res.replyIPs(r, ips), true, nil
+	case dnsmessage.TypeTXT:
+		var attrs []string
+		for _, c := range n.IPAM.Config {
+			attrs = append(attrs, "subnet="+c.Subnet)
+			if c.Gateway != "" {
+				attrs = append(attrs, "gateway="+c.Gateway)
+			}
+		}
+		for _, a := range attrs {
+			r.Answers = append(r.Answers, res.answer(q.Name, dnsmessage.TypeTXT, &dnsmessage.TXTResource{TXT: []string{a}}))
+		}
+	}
+	return r, true, nil
+}
+
+// inspectNetwork returns the network named name, matched case-insensitively
+// like any name queried. Docker's own lookup only finds the names as sent,
+// lowercased by then, networks with capitals in their names are found in
+// the list of networks.
+func (res *Resolver) inspectNetwork(name string) (types.NetworkResource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), res.timeout)
+	defer cancel()
+	n, err := res.cl.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+	// inspect matches ids and id prefixes too, only names are answered
+	if err == nil && n.Name == name {
+		return n, nil
+	}
+	if err != nil && !client.IsErrNotFound(err) {
+		return types.NetworkResource{}, err
+	}
+	nets, err := res.cl.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return types.NetworkResource{}, err
+	}
+	for _, n := range nets {
+		if strings.EqualFold(n.Name, name) {
+			return n, nil
+		}
+	}
+	return types.NetworkResource{}, errNotFound(name)
+}
@@ -0,0 +1,43 @@
+package resolver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestReplyNetwork(t *testing.T) {
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		{Name: "front", ID: "1111aaaa", IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "172.18.0.0/16", Gateway: "172.18.0.1"}}}},
+		{Name: "MyNet", ID: "2222bbbb", IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "172.19.0.0/16", Gateway: "172.19.0.1"}}}},
+	}
+	cfg := testConfig()
+	cfg.NetZone = true
+	res := New(fake, cfg)
+	tests := []struct {
+		name  string
+		rcode dnsmessage.RCode
+		ips   []string
+	}{
+		{"front.net.docker.", dnsmessage.RCodeSuccess, []string{"172.18.0.1"}},
+		{"FRONT.net.docker.", dnsmessage.RCodeSuccess, []string{"172.18.0.1"}},
+		{"mynet.net.docker.", dnsmessage.RCodeSuccess, []string{"172.19.0.1"}},
+		{"MyNet.net.docker.", dnsmessage.RCodeSuccess, []string{"172.19.0.1"}},
+		// ids aren't names
+		{"1111aaaa.net.docker.", dnsmessage.RCodeNameError, nil},
+		{"back.net.docker.", dnsmessage.RCodeNameError, nil},
+	}
+	for _, tt := range tests {
+		r := query(t, res, tt.name, dnsmessage.TypeA)
+		if r.RCode != tt.rcode {
+			t.Errorf("%s: rcode %v, want %v", tt.name, r.RCode, tt.rcode)
+		}
+		if got := answerIPs(r); !reflect.DeepEqual(got, tt.ips) {
+			t.Errorf("%s: ips %v, want %v", tt.name, got, tt.ips)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package resolver
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// parseReverseName turns a name like 2.0.17.172.in-addr.arpa. into
+// 172.17.0.2, and the 32 nibbles of an ip6.arpa. name into the IPv6 address
+// they spell backwards. It returns nil for other names.
+func parseReverseName(name string) net.IP {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		nibbles := make([]byte, len(labels))
+		for i, l := range labels {
+			if len(l) != 1 {
+				return nil
+			}
+			nibbles[len(labels)-1-i] = l[0]
+		}
+		ip, err := hex.DecodeString(string(nibbles))
+		if err != nil {
+			return nil
+		}
+		return net.IP(ip)
+	}
+	return nil
+}
+
+func (res *Resolver) replyPTR(r *dnsmessage.Message) (*dnsmessage.Message, error) {
+	q := r.Questions[0]
+	ip := parseReverseName(q.Name.String())
+	if ip == nil {
+		r.RCode = dnsmessage.RCodeNameError
+		return r, nil
+	}
+	name, ok, err := res.index.lookupIP(res.cl, ip)
+	if err != nil {
+		return lookupFailed(r, err)
+	}
+	if !ok {
+		r.RCode = dnsmessage.RCodeNameError
+		return r, nil
+	}
+	target, err := dnsmessage.NewName(encodeName(name) + "." + res.zone.Load().suffixes[0] + ".")
+	if err != nil {
+		return nil, err
+	}
+	r.RCode = dnsmessage.RCodeSuccess
+	r.Answers = []dnsmessage.Resource{res.answer(q.Name, q.Type, &dnsmessage.PTRResource{PTR: target})}
+	return r, nil
+}
@@ -0,0 +1,27 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   net.IP
+	}{
+		{"2.0.17.172.in-addr.arpa.", net.ParseIP("172.17.0.2")},
+		{"2.0.17.172.IN-ADDR.ARPA.", net.ParseIP("172.17.0.2")},
+		{"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.", net.ParseIP("4321:0:1:2:3:4:567:89ab")},
+		{"0.17.172.in-addr.arpa.", nil},
+		{"x.0.17.172.in-addr.arpa.", nil},
+		{"g.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.", nil},
+		{"ba.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.", nil},
+		{"web.docker.", nil},
+	}
+	for _, tt := range tests {
+		if got := parseReverseName(tt.name); !got.Equal(tt.ip) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.ip)
+		}
+	}
+}
@@ -0,0 +1,1265 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/singleflight"
+)
+
+// DockerClient is the part of the docker API the resolver uses,
+// *client.Client implements it.
+type DockerClient interface {
+	ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error)
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	ServiceInspectWithRaw(ctx context.Context, serviceID string, opts types.ServiceInspectOptions) (swarm.Service, []byte, error)
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+	NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error)
+}
+
+// Config holds the resolver settings.
+type Config struct {
+	// Suffixes are the zones answered for, see ParseSuffixes.
+	Suffixes []string
+	// TTL of the answers, in seconds. Inspect results are cached as long.
+	TTL uint32
+	// Forward is the upstream server (host:port) for names outside the
+	// suffixes and reverse lookups of ips that aren't containers', none if
+	// empty.
+	Forward string
+	// Network, when set, is the only network whose addresses are returned
+	// for containers attached to it.
+	Network string
+	// NameLabel is the container label giving additional names to resolve
+	// containers by, several containers may share one. Disabled if empty.
+	NameLabel string
+	// CNAMELabel is the container label giving comma separated names that
+	// are answered as cnames for the container. Disabled if empty.
+	CNAMELabel string
+	// Compose enables resolving compose services as service.project.
+	Compose bool
+	// NegativeTTL is how long names docker doesn't know about are
+	// remembered, not at all if zero.
+	NegativeTTL time.Duration
+	// DockerTimeout bounds each docker request made to answer a query.
+	DockerTimeout time.Duration
+	// Refresh, when set, has addresses answered from an index of all the
+	// running containers rebuilt that often and on container events, see
+	// RefreshIndex, instead of inspecting containers as they're queried.
+	Refresh time.Duration
+	// SOA sets the timers of the zones' SOA records.
+	SOA SOA
+	// NXDomainTTL is how long, in seconds, NXDOMAIN and NODATA answers may
+	// be cached, SOA.MinTTL if zero.
+	NXDomainTTL uint32
+	// NSName is the name of this server given in the zones' NS and SOA
+	// records, dcdns under each zone if empty.
+	NSName string
+	// HostIP, when set, is returned instead of the container addresses for
+	// containers publishing ports, unless they're published on a specific
+	// address.
+	HostIP net.IP
+	// Wildcard is the container name or ip that names matching no container
+	// resolve to, none if empty.
+	Wildcard string
+	// Hosts are names under the suffixes answered with fixed addresses,
+	// taking precedence over containers of the same name.
+	Hosts map[string][]net.IP
+	// ApexIPs are the addresses the zone apex resolves to, none if empty.
+	ApexIPs []net.IP
+	// GatewayName is answered with the gateway of GatewayNetwork, or of the
+	// default bridge if that's empty, none if empty.
+	GatewayName    string
+	GatewayNetwork string
+	// InspectRetries is how many times failed container inspects are
+	// retried within DockerTimeout.
+	InspectRetries int
+	// FilterLabel, key=value or key, limits the containers resolved to
+	// those with the label. All are if empty.
+	FilterLabel string
+	// Ambiguous is what names matching several containers get, one of the
+	// Ambiguous policies, AmbiguousAll if empty.
+	Ambiguous string
+	// TTLLabel is the container label overriding TTL for the container's
+	// addresses, none if empty.
+	TTLLabel string
+	// MaxUDPSize is the largest UDP payload advertised to clients using
+	// EDNS0, DefaultMaxUDPSize if zero.
+	MaxUDPSize int
+	// TXTID answers TXT queries for id.<name> with the full id of the
+	// container name, ahead of a container named like that.
+	TXTID bool
+	// NetZone answers queries for <network>.net under the suffixes with the
+	// gateways and subnets of the docker network, ahead of containers named
+	// like that.
+	NetZone bool
+	// Hostnames resolves containers by the hostname they were started with
+	// too, at the cost of inspecting every new container when the index is
+	// built. Container names win over hostnames.
+	Hostnames bool
+	// Warm looks started containers up ahead of the first query for them.
+	Warm bool
+	// DumpMessages logs every query and reply in full at debug level.
+	DumpMessages bool
+	// QueryLog, when set, gets a record of every query answered.
+	QueryLog *slog.Logger
+	// LabelPrefix enables resolving names starting with it to the
+	// containers with a label set to the rest of the name, see
+	// labelValueMatch. The label is named after the prefix without its
+	// trailing separator, one or more characters other than letters and
+	// digits. Disabled if empty.
+	LabelPrefix string
+	// Swarm enables resolving swarm services to their virtual ips, ahead of
+	// containers.
+	Swarm bool
+	// RequireHealthy hides containers with a healthcheck until they're
+	// healthy.
+	RequireHealthy bool
+	// Fuzzy resolves names matching no container otherwise to the one
+	// container whose name contains them, if there's a single one.
+	Fuzzy bool
+	// BareNames resolves single label names (web.) as containers too, names
+	// that aren't are handled as before. They may shadow top level domains.
+	BareNames bool
+	// RefuseRecursion answers queries asking for recursion (RD set) with
+	// REFUSED when there's no Forward server, instead of answering them
+	// without. Stub resolvers always ask for it.
+	RefuseRecursion bool
+	// SingleQuestion rejects queries with several questions with FORMERR
+	// instead of answering the first one.
+	SingleQuestion bool
+	// TXTLabels is the prefix of the labels answered in TXT records, none
+	// if empty.
+	TXTLabels string
+}
+
+// zone holds the settings that can be changed with Reload.
+type zone struct {
+	suffixes []string
+	ttl      uint32
+	fwd      string
+}
+
+// Resolver answers DNS queries for docker containers.
+type Resolver struct {
+	cl             DockerClient
+	zone           atomic.Pointer[zone]
+	network        string
+	compose        bool
+	timeout        time.Duration
+	index          *containerIndex
+	cache          *containerCache
+	services       *serviceCache
+	metrics        *Metrics
+	rr             *roundRobin
+	soaTimers      SOA
+	serial         *serial
+	hostIP         net.IP
+	wildcard       string
+	queryLog       *slog.Logger
+	txtLabels      string
+	swarm          bool
+	singleQuestion bool
+	requireHealthy bool
+	prebuilt       bool
+	nsName         string
+	labelPrefix    string
+	inflight       singleflight.Group
+	bareNames      bool
+	refuseRecurse  bool
+	hosts          map[string][]net.IP
+	gatewayName    string
+	gatewayNetwork string
+	nxdomainTTL    uint32
+	fuzzy          bool
+	apexIPs        []net.IP
+	dump           bool
+	warm           chan string // nil unless warming
+	txtID          bool
+	netZone        bool
+	maxUDPSize     int
+	ttlLabel       string
+	ambiguous      string
+	filter         labelFilter
+	inspectRetries int
+	rebuild        chan struct{}
+}
+
+// indexMaxAge is how long the index is used before being rebuilt on the next
+// lookup, unless prebuilt.
+const indexMaxAge = 10 * time.Second
+
+// New returns a resolver asking cl about containers.
+func New(cl DockerClient, cfg Config) *Resolver {
+	maxAge := indexMaxAge
+	if cfg.Refresh > 0 {
+		maxAge = cfg.Refresh
+	}
+	// without a label name left, there's nothing to match names on
+	valueLabel, labelPrefix := labelPrefixKey(cfg.LabelPrefix), strings.ToLower(cfg.LabelPrefix)
+	if valueLabel == "" {
+		labelPrefix = ""
+	}
+	res := &Resolver{
+		cl:             cl,
+		network:        cfg.Network,
+		compose:        cfg.Compose,
+		timeout:        cfg.DockerTimeout,
+		index:          newContainerIndex(maxAge, cfg.DockerTimeout, cfg.NameLabel, cfg.CNAMELabel, valueLabel, labelFilter(cfg.FilterLabel), cfg.Hostnames),
+		cache:          newContainerCache(time.Duration(cfg.TTL)*time.Second, cfg.NegativeTTL, time.Now),
+		services:       newServiceCache(time.Now),
+		metrics:        newMetrics(),
+		rr:             newRoundRobin(),
+		soaTimers:      cfg.SOA,
+		nxdomainTTL:    cfg.NXDomainTTL,
+		fuzzy:          cfg.Fuzzy,
+		apexIPs:        cfg.ApexIPs,
+		dump:           cfg.DumpMessages,
+		txtID:          cfg.TXTID,
+		netZone:        cfg.NetZone,
+		maxUDPSize:     cfg.MaxUDPSize,
+		ttlLabel:       cfg.TTLLabel,
+		ambiguous:      cfg.Ambiguous,
+		filter:         labelFilter(cfg.FilterLabel),
+		inspectRetries: cfg.InspectRetries,
+		serial:         newSerial(),
+		hostIP:         cfg.HostIP,
+		wildcard:       cfg.Wildcard,
+		queryLog:       cfg.QueryLog,
+		txtLabels:      cfg.TXTLabels,
+		swarm:          cfg.Swarm,
+		singleQuestion: cfg.SingleQuestion,
+		requireHealthy: cfg.RequireHealthy,
+		prebuilt:       cfg.Refresh > 0,
+		nsName:         cfg.NSName,
+		labelPrefix:    labelPrefix,
+		bareNames:      cfg.BareNames,
+		refuseRecurse:  cfg.RefuseRecursion,
+		hosts:          make(map[string][]net.IP, len(cfg.Hosts)),
+		gatewayName:    strings.ToLower(strings.TrimSuffix(cfg.GatewayName, ".")),
+		gatewayNetwork: cfg.GatewayNetwork,
+		rebuild:        make(chan struct{}, 1),
+	}
+	for name, ips := range cfg.Hosts {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		res.hosts[name] = append(res.hosts[name], ips...)
+	}
+	if res.maxUDPSize == 0 {
+		res.maxUDPSize = DefaultMaxUDPSize
+	}
+	if cfg.Warm {
+		res.warm = make(chan string, warmQueue)
+	}
+	res.zone.Store(&zone{suffixes: cfg.Suffixes, ttl: cfg.TTL, fwd: cfg.Forward})
+	return res
+}
+
+// Reload applies the suffixes, ttl and upstream server of cfg to the
+// queries answered from now on, the rest of cfg is ignored.
+func (res *Resolver) Reload(cfg Config) {
+	res.zone.Store(&zone{suffixes: cfg.Suffixes, ttl: cfg.TTL, fwd: cfg.Forward})
+	res.cache.setTTL(time.Duration(cfg.TTL) * time.Second)
+}
+
+// RefreshIndex builds the index of running containers right away, then
+// every d and after container events until ctx is done. It's only needed
+// with Config.Refresh set, d should be the same.
+func (res *Resolver) RefreshIndex(ctx context.Context, d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		if err := res.index.rebuild(res.cl); err != nil {
+			slog.Warn("can't build the container index", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-res.rebuild:
+		}
+	}
+}
+
+// SweepCache evicts expired cache entries every d until ctx is done.
+func (res *Resolver) SweepCache(ctx context.Context, d time.Duration) {
+	res.cache.sweepEvery(ctx, d)
+}
+
+// Metrics returns the resolver's query and lookup counters.
+func (res *Resolver) Metrics() *Metrics {
+	return res.metrics
+}
+
+// Handle returns the packed reply to the query in m, sent by from over udp
+// if udp is set, over a stream otherwise.
+func (res *Resolver) Handle(m []byte, from net.Addr, udp bool) ([]byte, error) {
+	res.metrics.query(m)
+	dump := res.dump && slog.Default().Enabled(context.Background(), slog.LevelDebug)
+	if dump {
+		dumpMessage("query dump", from, m)
+	}
+	start := time.Now()
+	rb, err := res.handle(m, udp)
+	if err != nil {
+		return nil, err
+	}
+	res.metrics.reply(rb)
+	if dump {
+		dumpMessage("reply dump", from, rb)
+	}
+	if res.queryLog != nil || slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		res.logReply(from, rb, time.Since(start))
+	}
+	return rb, nil
+}
+
+// logReply logs the question, answered addresses and rcode of rb at debug
+// level, and to the query log along with the time it took to answer.
+func (res *Resolver) logReply(from net.Addr, rb []byte, took time.Duration) {
+	var r dnsmessage.Message
+	if err := r.Unpack(rb); err != nil || len(r.Questions) == 0 {
+		return
+	}
+	var ips []string
+	for _, a := range r.Answers {
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(b.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(b.AAAA[:]).String())
+		}
+	}
+	q := r.Questions[0]
+	slog.Debug("query", "client", from, "name", q.Name.String(), "type", q.Type, "ips", ips, "rcode", r.RCode)
+	if res.queryLog != nil {
+		client := from.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		res.queryLog.Info("query",
+			"client", client,
+			"name", q.Name.String(),
+			"type", strings.TrimPrefix(q.Type.String(), "Type"),
+			"rcode", strings.TrimPrefix(r.RCode.String(), "RCode"),
+			"ips", strings.Join(ips, ","),
+			"took", took,
+		)
+	}
+}
+
+func (res *Resolver) handle(m []byte, udp bool) ([]byte, error) {
+	fwd := res.zone.Load().fwd
+	forward := fwd != "" && res.outOfZone(m)
+	if forward && !res.bareNames {
+		return res.forwardQuery(fwd, m, udp)
+	}
+	msg, size, err := res.reply(m)
+	if err != nil {
+		return nil, fmt.Errorf("can't create reply: %w", err)
+	}
+	// bare names that aren't containers, reverse lookups of other ips
+	if forward && msg.RCode == dnsmessage.RCodeRefused || fwd != "" && reverseMiss(msg) {
+		return res.forwardQuery(fwd, m, udp)
+	}
+	rb, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("can't pack message: %w", err)
+	}
+	if udp && len(rb) > size {
+		if rb, err = truncate(msg, size); err != nil {
+			return nil, fmt.Errorf("can't pack message: %w", err)
+		}
+	}
+	return rb, nil
+}
+
+// Reply returns the reply to the query in msg.
+func (res *Resolver) Reply(msg []byte) (*dnsmessage.Message, error) {
+	r, _, err := res.reply(msg)
+	return r, err
+}
+
+// reply returns the reply to the query in msg and the largest UDP reply the
+// client accepts.
+func (res *Resolver) reply(msg []byte) (*dnsmessage.Message, int, error) {
+	r := &dnsmessage.Message{}
+	if err := r.Unpack(msg); err != nil {
+		fr, ferr := formatError(msg)
+		if ferr != nil {
+			return nil, 0, fmt.Errorf("%w (%v)", err, ferr)
+		}
+		return fr, minUDPSize, nil
+	}
+	if r.Header.Response {
+		return nil, 0, fmt.Errorf("go a response instead of a query")
+	}
+	if r.Header.OpCode != 0 {
+		return errorReply(r, dnsmessage.RCodeNotImplemented), minUDPSize, nil
+	}
+	if len(r.Questions) < 1 {
+		return errorReply(r, dnsmessage.RCodeFormatError), minUDPSize, nil
+	}
+	if len(r.Questions) > 1 && res.singleQuestion {
+		return errorReply(r, dnsmessage.RCodeFormatError), minUDPSize, nil
+	}
+	size, err := replyEDNS(r, res.maxUDPSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err = res.answerQuestion(r)
+	return r, size, err
+}
+
+// formatError builds a FORMERR reply to a query that can't be unpacked, so
+// the client fails fast instead of waiting. It needs at least the query id,
+// the rest of the header and the question are echoed if they can be parsed.
+func formatError(m []byte) (*dnsmessage.Message, error) {
+	if len(m) < 2 {
+		return nil, fmt.Errorf("no query id")
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(m)
+	if err != nil {
+		h = dnsmessage.Header{ID: binary.BigEndian.Uint16(m)}
+		h.Response = len(m) > 2 && m[2]&0x80 != 0
+	}
+	if h.Response {
+		return nil, fmt.Errorf("not a query")
+	}
+	r := &dnsmessage.Message{Header: h}
+	if err == nil {
+		if q, err := p.Question(); err == nil {
+			r.Questions = []dnsmessage.Question{q}
+		}
+	}
+	return errorReply(r, dnsmessage.RCodeFormatError), nil
+}
+
+// errorReply answers queries that aren't processed (opcodes other than
+// QUERY, malformed queries, several questions in strict mode) with rcode,
+// the opcode and the questions are echoed back.
+func errorReply(r *dnsmessage.Message, rcode dnsmessage.RCode) *dnsmessage.Message {
+	r.Response = true
+	r.Truncated = false
+	r.Authoritative = false
+	r.RecursionAvailable = false
+	r.RCode = rcode
+	r.Answers, r.Authorities, r.Additionals = nil, nil, nil
+	return r
+}
+
+func (res *Resolver) answerQuestion(r *dnsmessage.Message) (*dnsmessage.Message, error) {
+	rd := r.RecursionDesired
+	r.RecursionAvailable = false
+	r.RecursionDesired = false
+	r.Authoritative = false
+	r.Response = true
+	// the TC bit means nothing in a query, in the reply it's set by truncate
+	r.Truncated = false
+	r.Questions = r.Questions[:1]
+	if rd && res.refuseRecurse && res.zone.Load().fwd == "" {
+		r.RCode = dnsmessage.RCodeRefused
+		return r, nil
+	}
+	q := r.Questions[0]
+	if q.Type == dnsmessage.TypePTR && q.Class == dnsmessage.ClassINET {
+		return res.replyPTR(r)
+	}
+	if q.Class != dnsmessage.ClassINET {
+		r.RCode = dnsmessage.RCodeNameError
+		return r, nil
+	}
+	// names are matched case-insensitively, the answer still echoes q.Name as sent
+	cn := canonicalName(q.Name.String())
+	if suffix, ok := res.apex(cn); ok {
+		r.Authoritative = true
+		return res.replyApex(r, suffix)
+	}
+	name, suffix, ok := res.splitName(cn)
+	if !ok {
+		if res.bareNames && strings.Count(cn, ".") == 1 && cn != "." {
+			if br, err := res.answerBare(r, strings.TrimSuffix(cn, ".")); err != nil || br != nil {
+				return br, err
+			}
+		}
+		// we're not authoritative for names outside the suffixes and, unless
+		// forwarding, don't recurse for them either
+		r.RCode = dnsmessage.RCodeRefused
+		r.Answers, r.Authorities = nil, nil
+		return r, nil
+	}
+	// we're the authority for names under the suffixes
+	r.Authoritative = true
+	r, err := res.answerName(r, decodeName(name), suffix)
+	if err != nil {
+		return nil, err
+	}
+	return res.negative(r, suffix)
+}
+
+// answerBare answers a query for a single label name as if it were under
+// the first suffix, nil if that doesn't find a container so the name is
+// handled like any other out of zone name.
+func (res *Resolver) answerBare(r *dnsmessage.Message, name string) (*dnsmessage.Message, error) {
+	br, err := res.answerName(r, decodeName(name), res.zone.Load().suffixes[0])
+	if err != nil {
+		return nil, err
+	}
+	if br.RCode != dnsmessage.RCodeSuccess || len(br.Answers) == 0 {
+		return nil, nil
+	}
+	// not our zone, so not authoritative
+	br.Authoritative = false
+	return br, nil
+}
+
+// answerName answers the query for name under suffix.
+func (res *Resolver) answerName(r *dnsmessage.Message, name, suffix string) (*dnsmessage.Message, error) {
+	if r, ok, err := res.replyNetwork(r, name); ok || err != nil {
+		return r, err
+	}
+	if r, ok := res.replyHost(r, name); ok {
+		return r, nil
+	}
+	if r, ok, err := res.replyGateway(r, name); ok || err != nil {
+		return r, err
+	}
+	if r, ok, err := res.replyCNAME(r, name, suffix); ok || err != nil {
+		return r, err
+	}
+	switch r.Questions[0].Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeALL:
+		return res.replyAddress(r, r.Questions[0].Name, name)
+	case dnsmessage.TypeSRV:
+		return res.replySRV(r, name, suffix)
+	case dnsmessage.TypeTXT:
+		if res.txtID && strings.HasPrefix(name, idPrefix) {
+			return res.replyID(r, strings.TrimPrefix(name, idPrefix))
+		}
+		return res.replyTXT(r, name)
+	}
+	return res.replyNoData(r, name)
+}
+
+// replyNoData answers queries for record types containers don't have, like
+// MX or CAA: NODATA if name exists, NXDOMAIN otherwise (RFC 8020).
+func (res *Resolver) replyNoData(r *dnsmessage.Message, name string) (*dnsmessage.Message, error) {
+	if _, err := res.lookupName(name); err != nil {
+		return lookupFailed(r, err)
+	}
+	r.RCode = dnsmessage.RCodeSuccess
+	r.Answers = nil
+	return r, nil
+}
+
+// replyAddress answers A and AAAA queries, and ANY with both, with records
+// for owner. Names with several addresses get them in a rotating order,
+// those without any of the family asked for get NODATA.
+func (res *Resolver) replyAddress(r *dnsmessage.Message, owner dnsmessage.Name, name string) (*dnsmessage.Message, error) {
+	q := r.Questions[0]
+	m, err := res.lookupName(name)
+	if err != nil {
+		return lookupFailed(r, err)
+	}
+	offset := res.rr.offset(name)
+	var answers []dnsmessage.Resource
+	if q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL {
+		for _, ip := range rotate(ipv4s(m.nets), offset) {
+			answers = append(answers, res.answer(owner, dnsmessage.TypeA, &dnsmessage.AResource{A: ip}))
+		}
+	}
+	if q.Type == dnsmessage.TypeAAAA || q.Type == dnsmessage.TypeALL {
+		for _, ip := range rotate(ipv6s(m.nets), offset) {
+			answers = append(answers, res.answer(owner, dnsmessage.TypeAAAA, &dnsmessage.AAAAResource{AAAA: ip}))
+		}
+	}
+	if ttl, ok := res.labelTTL(m); ok {
+		for i := range answers {
+			answers[i].Header.TTL = ttl
+		}
+	}
+	r.RCode = dnsmessage.RCodeSuccess
+	r.Answers = answers
+	return r, nil
+}
+
+// labelTTL returns the ttl the ttl label of the containers of m sets for
+// their answers, the lowest if several do, false if none has a number in it.
+func (res *Resolver) labelTTL(m match) (uint32, bool) {
+	if res.ttlLabel == "" {
+		return 0, false
+	}
+	var (
+		ttl uint32
+		ok  bool
+	)
+	for _, c := range m.containers {
+		v, has := c.labels[res.ttlLabel]
+		if !has {
+			continue
+		}
+		t, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			slog.Debug("invalid ttl label", "id", c.id, "label", res.ttlLabel, "value", v)
+			continue
+		}
+		if !ok || uint32(t) < ttl {
+			ttl, ok = uint32(t), true
+		}
+	}
+	return ttl, ok
+}
+
+// answer builds a record with the zone's ttl. Records answering the question
+// are owned by q.Name as the client sent it, never the lowercased name used
+// for matching, as resolvers randomizing the case (DNS 0x20) check the echo.
+func (res *Resolver) answer(name dnsmessage.Name, t dnsmessage.Type, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  name,
+			Type:  t,
+			Class: dnsmessage.ClassINET,
+			TTL:   res.zone.Load().ttl,
+		},
+		Body: body,
+	}
+}
+
+// ParseSuffixes splits a comma separated list of suffixes, longest first so
+// that nested suffixes (dev.docker, docker) match the most specific one.
+func ParseSuffixes(list string) []string {
+	var suffixes []string
+	for _, sf := range strings.Split(list, ",") {
+		if sf = strings.Trim(strings.ToLower(strings.TrimSpace(sf)), "."); sf != "" {
+			suffixes = append(suffixes, sf)
+		}
+	}
+	sort.Slice(suffixes, func(i, j int) bool { return len(suffixes[i]) > len(suffixes[j]) })
+	return suffixes
+}
+
+// canonicalName lowercases name and makes it fully qualified, without
+// empty labels: web..docker and web.docker. both become web.docker.
+func canonicalName(name string) string {
+	var labels []string
+	for _, l := range strings.Split(strings.ToLower(name), ".") {
+		if l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// splitName splits a canonical name into the container
+// name and the suffix it's under.
+func (res *Resolver) splitName(fqdn string) (string, string, bool) {
+	for _, sf := range res.zone.Load().suffixes {
+		if strings.HasSuffix(fqdn, "."+sf+".") {
+			return strings.TrimSuffix(fqdn, "."+sf+"."), sf, true
+		}
+	}
+	return "", "", false
+}
+
+// decodeName turns the punycode labels (xn--...) of name into unicode so
+// they match the container names and aliases they stand for. Names that
+// aren't valid punycode are used as sent.
+func decodeName(name string) string {
+	if u, err := idna.ToUnicode(name); err == nil {
+		return u
+	}
+	return name
+}
+
+// encodeName is the reverse of decodeName, for container names put in
+// answers.
+func encodeName(name string) string {
+	if a, err := idna.ToASCII(name); err == nil {
+		return a
+	}
+	return name
+}
+
+// lookupFailed turns a container lookup error into a reply. Short ID
+// prefixes are accepted as names; a prefix matching several containers, which
+// ambiguousPrefix turns into an invalid parameter error, is answered with
+// SERVFAIL under -ambiguous servfail since the name can't be resolved
+// unambiguously. Any other error (docker timing out or being unreachable) is
+// answered with SERVFAIL too, so clients can retry or fail fast instead of
+// waiting for a reply that never comes.
+func lookupFailed(r *dnsmessage.Message, err error) (*dnsmessage.Message, error) {
+	switch {
+	case client.IsErrNotFound(err):
+		r.RCode = dnsmessage.RCodeNameError
+	case errdefs.IsInvalidParameter(err):
+		slog.Warn("ambiguous container name", "err", err)
+		r.RCode = dnsmessage.RCodeServerFailure
+		r.Authoritative = false
+	default:
+		slog.Warn("container lookup error", "err", err)
+		r.RCode = dnsmessage.RCodeServerFailure
+		r.Authoritative = false
+	}
+	return r, nil
+}
+
+// inspectContainer returns the inspect result for the named running
+// container. Stopped containers have no address to reach, they're reported
+// as not found, as are containers not healthy yet if healthy ones are
+// required.
+func (res *Resolver) inspectContainer(name string) (types.ContainerJSON, error) {
+	info, err := res.inspectCached(name)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	if info.State == nil || !info.State.Running {
+		return types.ContainerJSON{}, errNotFound(name)
+	}
+	if info.Config == nil || !res.filter.match(info.Config.Labels) {
+		return types.ContainerJSON{}, errNotFound(name)
+	}
+	if h := info.State.Health; res.requireHealthy && h != nil && h.Status != types.Healthy && h.Status != types.NoHealthcheck {
+		return types.ContainerJSON{}, errNotFound(name)
+	}
+	return info, nil
+}
+
+// inspectBackoff is the wait before the first retry of a failed inspect,
+// doubled for each one after.
+const inspectBackoff = 10 * time.Millisecond
+
+// inspectRetrying inspects the named container, retrying up to
+// Config.InspectRetries times while ctx allows on errors other than the
+// container not being found or the name being an ambiguous id prefix, which
+// fails with the error of ambiguousPrefix.
+func (res *Resolver) inspectRetrying(ctx context.Context, name string) (types.ContainerJSON, error) {
+	backoff := inspectBackoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		info, err := res.cl.ContainerInspect(ctx, name)
+		res.metrics.inspect(time.Since(start))
+		if err == nil || client.IsErrNotFound(err) {
+			return info, err
+		}
+		if err = res.ambiguousPrefix(ctx, name, err); errdefs.IsInvalidParameter(err) || attempt == res.inspectRetries {
+			return info, err
+		}
+		slog.Debug("retrying inspect", "name", name, "err", err)
+		select {
+		case <-ctx.Done():
+			return info, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// inspectCached returns the cached inspect result for name, asking docker
+// only on a miss or once the entry has expired. Names are case-insensitive,
+// docker's aren't: names it doesn't know as sent are looked up in the index,
+// ignoring case, and inspected by id.
+func (res *Resolver) inspectCached(name string) (types.ContainerJSON, error) {
+	key := strings.ToLower(name)
+	if e, ok := res.cache.get(key); ok {
+		res.metrics.cache(true)
+		if e.missing {
+			return types.ContainerJSON{}, errNotFound(name)
+		}
+		return e.info, nil
+	}
+	res.metrics.cache(false)
+	// concurrent misses for a name share one inspect
+	v, err, _ := res.inflight.Do(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), res.timeout)
+		defer cancel()
+		info, err := res.inspectRetrying(ctx, name)
+		if client.IsErrNotFound(err) {
+			if c, ok, lerr := res.index.lookupContainer(res.cl, name); lerr == nil && ok && containerName(c) != name {
+				info, err = res.inspectRetrying(ctx, c.ID)
+			}
+		}
+		if err != nil {
+			if client.IsErrNotFound(err) {
+				res.cache.setMissing(key)
+			}
+			return nil, err
+		}
+		res.cache.set(key, info)
+		return info, nil
+	})
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	return v.(types.ContainerJSON), nil
+}
+
+// ambiguousPrefix returns an invalid parameter error if the inspect of name
+// failed with err because name is the id prefix of several containers, err
+// otherwise. Docker rejects such prefixes with an error response the client
+// doesn't tell from others, they're counted by listing the containers.
+func (res *Resolver) ambiguousPrefix(ctx context.Context, name string, err error) error {
+	if !isIDPrefix(name) {
+		return err
+	}
+	containers, lerr := res.listIDPrefix(ctx, name, types.ContainerListOptions{All: true})
+	if lerr != nil || len(containers) < 2 {
+		return err
+	}
+	return errdefs.InvalidParameter(fmt.Errorf("%d containers have ids starting with %s: %w", len(containers), name, err))
+}
+
+// indexedIDPrefix returns the indexed container whose id starts with
+// prefix, like docker resolves prefixes given to inspect. A prefix of several
+// containers fails with an invalid parameter error, as from ambiguousPrefix.
+func (res *Resolver) indexedIDPrefix(prefix string) (types.Container, bool, error) {
+	containers, err := res.index.lookupIDPrefix(res.cl, prefix)
+	switch {
+	case err != nil:
+		return types.Container{}, false, err
+	case len(containers) > 1:
+		return types.Container{}, false, errdefs.InvalidParameter(fmt.Errorf("%d containers have ids starting with %s", len(containers), prefix))
+	case len(containers) == 1:
+		return containers[0], true, nil
+	}
+	return types.Container{}, false, nil
+}
+
+// listIDPrefix lists the containers whose id starts with prefix. Docker's id
+// filter matches anywhere in the id, the others are dropped.
+func (res *Resolver) listIDPrefix(ctx context.Context, prefix string, options types.ContainerListOptions) ([]types.Container, error) {
+	if options.Filters.Len() == 0 {
+		options.Filters = filters.NewArgs()
+	}
+	options.Filters.Add("id", prefix)
+	containers, err := res.cl.ContainerList(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	var matched []types.Container
+	for _, c := range containers {
+		if strings.HasPrefix(c.ID, prefix) {
+			matched = append(matched, c)
+		}
+	}
+	return matched, nil
+}
+
+// isIDPrefix reports whether name could be the start of a container id, 64
+// lowercase hex digits.
+func isIDPrefix(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func errNotFound(name string) error {
+	return errdefs.NotFound(fmt.Errorf("no such container: %s", name))
+}
+
+// hostEndpoint stands in for containers sharing the host's network stack,
+// they're reachable on the loopback addresses.
+var hostEndpoint = &network.EndpointSettings{IPAddress: "127.0.0.1", GlobalIPv6Address: "::1"}
+
+// found is a container a name resolved to, as much of it as the answers
+// other than addresses need.
+type found struct {
+	id, image, status string
+	labels            map[string]string
+	ports             []nat.Port // exposed
+}
+
+func inspectedContainer(info types.ContainerJSON) found {
+	f := found{id: info.ID, status: info.State.Status}
+	if info.Config != nil {
+		f.image, f.labels = info.Config.Image, info.Config.Labels
+	}
+	if info.NetworkSettings != nil {
+		for p := range info.NetworkSettings.Ports {
+			f.ports = append(f.ports, p)
+		}
+	}
+	return f
+}
+
+func listedContainer(c types.Container) found {
+	f := found{id: c.ID, image: c.Image, status: c.State, labels: c.Labels}
+	for _, p := range c.Ports {
+		if port, err := nat.NewPort(p.Type, strconv.Itoa(int(p.PrivatePort))); err == nil {
+			f.ports = append(f.ports, port)
+		}
+	}
+	return f
+}
+
+// match is what a name resolved to: the endpoints its addresses are
+// answered from and the containers they belong to, none for swarm services
+// and wildcard ips.
+type match struct {
+	nets       []*network.EndpointSettings
+	containers []found
+}
+
+// lookupName returns what the named container resolves to, its endpoints
+// sorted by network name so answers come out in a stable order. Swarm
+// services are tried first, if enabled, then the container itself: from
+// the prebuilt index if there's one, by inspecting it otherwise. Names that
+// aren't containers are looked up, in this order, as:
+//
+//   - names given by the name label
+//   - network aliases, answered with any of the alias's networks
+//   - names or aliases qualified by a network (web.mynet), answered with
+//     that network's address only
+//   - hostnames, if enabled
+//   - compose services (service.project), if enabled
+//   - label values (role-db for role=db), if there's a label prefix
+//   - the one container whose name contains name, if fuzzy
+//
+// The first match wins, so a container named like another's hostname is
+// the one answered. Names matching none of them get the wildcard's
+// endpoints, if any.
+func (res *Resolver) lookupName(name string) (match, error) {
+	if res.swarm {
+		if nets, err := res.serviceVIPs(name); !client.IsErrNotFound(err) {
+			return match{nets: nets}, err
+		}
+	}
+	var (
+		info types.ContainerJSON
+		err  error
+	)
+	if res.prebuilt {
+		c, ok, lerr := res.index.lookupContainer(res.cl, name)
+		if lerr == nil && !ok && isIDPrefix(name) {
+			c, ok, lerr = res.indexedIDPrefix(name)
+		}
+		if lerr != nil && !errdefs.IsInvalidParameter(lerr) {
+			return match{}, lerr
+		}
+		if ok && (!res.requireHealthy || listedHealthy(c)) {
+			if m := res.listedMatch([]types.Container{c}); len(m.nets) > 0 {
+				return m, nil
+			}
+			return match{}, fmt.Errorf("error getting network info for %s", name)
+		}
+		if err = lerr; err == nil {
+			err = errNotFound(name)
+		}
+	} else {
+		info, err = res.inspectContainer(name)
+	}
+	if errdefs.IsInvalidParameter(err) {
+		return res.ambiguousMatch(name, err)
+	}
+	if client.IsErrNotFound(err) {
+		containers, lerr := res.index.lookupLabel(res.cl, name)
+		if lerr != nil {
+			return match{}, lerr
+		}
+		if len(containers) > 0 {
+			return res.listedMatch(containers), nil
+		}
+		e, ok, aerr := res.index.lookupAlias(res.cl, name)
+		if aerr != nil {
+			return match{}, aerr
+		}
+		if ok {
+			return e.match(), nil
+		}
+		if strings.Contains(name, ".") {
+			e, ok, serr := res.index.lookupScoped(res.cl, name)
+			if serr != nil {
+				return match{}, serr
+			}
+			if ok {
+				return e.match(), nil
+			}
+		}
+		if containers, herr := res.index.lookupHostname(res.cl, name); herr != nil || len(containers) > 0 {
+			return res.listedMatch(containers), herr
+		}
+		if res.compose && strings.Count(name, ".") == 1 {
+			m, cerr := res.serviceMatch(name)
+			if cerr != nil || len(m.nets) > 0 {
+				return m, cerr
+			}
+		}
+		if res.labelPrefix != "" && strings.HasPrefix(name, res.labelPrefix) {
+			m, lerr := res.labelValueMatch(name)
+			if lerr != nil || len(m.nets) > 0 {
+				return m, lerr
+			}
+		}
+		if res.fuzzy {
+			containers, ferr := res.index.lookupSubstring(res.cl, name)
+			if ferr != nil {
+				return match{}, ferr
+			}
+			if len(containers) == 1 {
+				return res.listedMatch(containers), nil
+			}
+			if len(containers) > 1 {
+				slog.Debug("ambiguous fuzzy match", "name", name, "matches", len(containers))
+				return match{}, err
+			}
+		}
+		if res.wildcard != "" && !strings.EqualFold(name, res.wildcard) {
+			return res.wildcardMatch()
+		}
+	}
+	if err != nil {
+		return match{}, err
+	}
+	c := []found{inspectedContainer(info)}
+	if res.hostIP != nil {
+		var hostIPs []string
+		for _, bindings := range info.HostConfig.PortBindings {
+			for _, b := range bindings {
+				hostIPs = append(hostIPs, b.HostIP)
+			}
+		}
+		if len(hostIPs) > 0 {
+			return match{nets: []*network.EndpointSettings{res.publishedEndpoint(hostIPs)}, containers: c}, nil
+		}
+	}
+	nets := res.endpoints(info.HostConfig.NetworkMode, info.NetworkSettings.Networks)
+	if len(nets) == 0 {
+		return match{}, fmt.Errorf("error getting network info for %s", name)
+	}
+	return match{nets: nets, containers: c}, nil
+}
+
+// wildcardMatch returns the endpoint of the wildcard ip or what the wildcard
+// container resolves to.
+func (res *Resolver) wildcardMatch() (match, error) {
+	if ip := net.ParseIP(res.wildcard); ip != nil {
+		if ip.To4() != nil {
+			return match{nets: []*network.EndpointSettings{{IPAddress: ip.String()}}}, nil
+		}
+		return match{nets: []*network.EndpointSettings{{GlobalIPv6Address: ip.String()}}}, nil
+	}
+	return res.lookupName(res.wildcard)
+}
+
+// Policies for names matching several containers, as id prefixes do.
+const (
+	AmbiguousAll      = "all"
+	AmbiguousNXDomain = "nxdomain"
+	AmbiguousServFail = "servfail"
+)
+
+// ambiguousMatch returns, for a name docker found ambiguous with err, the
+// running containers whose id starts with it, or fails like a name matching
+// none or with err, as set by Config.Ambiguous.
+func (res *Resolver) ambiguousMatch(name string, err error) (match, error) {
+	switch res.ambiguous {
+	case AmbiguousNXDomain:
+		return match{}, errNotFound(name)
+	case AmbiguousServFail:
+		return match{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), res.timeout)
+	defer cancel()
+	containers, lerr := res.listIDPrefix(ctx, name, types.ContainerListOptions{Filters: res.filter.args()})
+	if lerr != nil {
+		return match{}, lerr
+	}
+	sort.Slice(containers, func(i, j int) bool { return containerName(containers[i]) < containerName(containers[j]) })
+	if m := res.listedMatch(containers); len(m.nets) > 0 {
+		return m, nil
+	}
+	return match{}, errNotFound(name)
+}
+
+// labelValueMatch returns the running containers with the label named after
+// the label prefix set to the rest of name: with the prefix role-, role-db
+// names the containers labelled role=db. Label values are matched
+// case-insensitively, like names. None match if name is just the prefix.
+func (res *Resolver) labelValueMatch(name string) (match, error) {
+	value := strings.TrimPrefix(name, res.labelPrefix)
+	if value == "" {
+		return match{}, nil
+	}
+	containers, err := res.index.lookupValue(res.cl, value)
+	if err != nil {
+		return match{}, err
+	}
+	return res.listedMatch(containers), nil
+}
+
+// labelPrefixKey returns the name of the label prefix names, prefix without
+// its trailing separator: role for role- or role__. The case of the label
+// name is kept, labels are case-sensitive.
+func labelPrefixKey(prefix string) string {
+	return strings.TrimRightFunc(prefix, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+}
+
+// serviceMatch returns every replica of a compose service, answered in
+// rotating order like any name with several addresses. Replicas started or
+// stopped are picked up as their events invalidate the index, clients keep
+// the previous set for up to the answer ttl.
+func (res *Resolver) serviceMatch(name string) (match, error) {
+	containers, err := res.index.lookupService(res.cl, name)
+	if err != nil {
+		return match{}, err
+	}
+	return res.listedMatch(containers), nil
+}
+
+// listedMatch returns the endpoints of each of containers, along with the
+// containers that have some.
+func (res *Resolver) listedMatch(containers []types.Container) match {
+	var m match
+	for _, c := range containers {
+		if res.requireHealthy && !listedHealthy(c) {
+			continue
+		}
+		var hostIPs []string
+		for _, p := range c.Ports {
+			if p.PublicPort != 0 {
+				hostIPs = append(hostIPs, p.IP)
+			}
+		}
+		switch {
+		case res.hostIP != nil && len(hostIPs) > 0:
+			m.nets = append(m.nets, res.publishedEndpoint(hostIPs))
+		case c.NetworkSettings != nil:
+			nets := res.endpoints(container.NetworkMode(c.HostConfig.NetworkMode), c.NetworkSettings.Networks)
+			if len(nets) == 0 {
+				continue
+			}
+			m.nets = append(m.nets, nets...)
+		default:
+			continue
+		}
+		m.containers = append(m.containers, listedContainer(c))
+	}
+	return m
+}
+
+// listedHealthy reports whether c is healthy or has no healthcheck, going by
+// the status the container list reports, e.g. "Up 2 minutes (healthy)".
+func listedHealthy(c types.Container) bool {
+	return !strings.Contains(c.Status, "(unhealthy)") && !strings.Contains(c.Status, "(health: starting)")
+}
+
+// publishedEndpoint stands in for a container publishing ports on hostIPs,
+// ports published on all addresses are reached on the host IP.
+func (res *Resolver) publishedEndpoint(hostIPs []string) *network.EndpointSettings {
+	ep := &network.EndpointSettings{}
+	for _, s := range hostIPs {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil || ip.IsUnspecified():
+			ip = res.hostIP
+		case ip.To4() == nil:
+			if ep.GlobalIPv6Address == "" {
+				ep.GlobalIPv6Address = ip.String()
+			}
+			continue
+		}
+		if ep.IPAddress == "" {
+			ep.IPAddress = ip.String()
+		}
+	}
+	return ep
+}
+
+// endpoints picks the endpoints of a container attached to networks. If
+// the container is attached to the configured network only that endpoint is
+// returned, otherwise all of them sorted by network name.
+func (res *Resolver) endpoints(mode container.NetworkMode, networks map[string]*network.EndpointSettings) []*network.EndpointSettings {
+	if mode.IsHost() {
+		return []*network.EndpointSettings{hostEndpoint}
+	}
+	if netInfo, ok := networks[res.network]; ok && res.network != "" {
+		return []*network.EndpointSettings{netInfo}
+	}
+	names := make([]string, 0, len(networks))
+	for n := range networks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	nets := make([]*network.EndpointSettings, 0, len(names))
+	for _, n := range names {
+		nets = append(nets, networks[n])
+	}
+	return nets
+}
+
+var errNoAddress = errors.New("can't get IP address")
+
+// ResolveContainerName returns the IPv4 addresses of the named container,
+// one per network it's attached to.
+func (res *Resolver) ResolveContainerName(name string) ([][4]byte, error) {
+	m, err := res.lookupName(name)
+	if err != nil {
+		return nil, err
+	}
+	ips := ipv4s(m.nets)
+	if len(ips) == 0 {
+		return nil, errNoAddress
+	}
+	return ips, nil
+}
+
+// ipv4s returns the IPv4 addresses of nets.
+func ipv4s(nets []*network.EndpointSettings) [][4]byte {
+	var ips [][4]byte
+	for _, netInfo := range nets {
+		if ip := net.ParseIP(netInfo.IPAddress).To4(); len(ip) != 0 {
+			ips = append(ips, [4]byte{ip[0], ip[1], ip[2], ip[3]})
+		}
+	}
+	return ips
+}
+
+// ResolveContainerNameV6 returns the IPv6 addresses of the named container,
+// none if the container exists but has no IPv6 address.
+func (res *Resolver) ResolveContainerNameV6(name string) ([][16]byte, error) {
+	m, err := res.lookupName(name)
+	if err != nil {
+		return nil, err
+	}
+	return ipv6s(m.nets), nil
+}
+
+// ipv6s returns the IPv6 addresses of nets.
+func ipv6s(nets []*network.EndpointSettings) [][16]byte {
+	var ips [][16]byte
+	for _, netInfo := range nets {
+		if ip := net.ParseIP(netInfo.GlobalIPv6Address).To16(); len(ip) != 0 {
+			var a [16]byte
+			copy(a[:], ip)
+			ips = append(ips, a)
+		}
+	}
+	return ips
+}
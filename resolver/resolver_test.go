@@ -0,0 +1,339 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestReply(t *testing.T) {
+	fake := newFakeDocker(
+		ctr("web", "aaaa1111", ep("bridge", "172.17.0.2", "")),
+		ctr("dual", "bbbb2222", ep("bridge", "172.17.0.3", "fd00::3")),
+		ctr("v6", "cccc3333", ep("bridge", "", "fd00::4")),
+	)
+	res := New(fake, testConfig())
+	tests := []struct {
+		name  string
+		typ   dnsmessage.Type
+		rcode dnsmessage.RCode
+		ips   []string
+		ptr   string
+	}{
+		{"web.docker.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"172.17.0.2"}, ""},
+		{"dual.docker.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd00::3"}, ""},
+		{"dual.docker.", dnsmessage.TypeALL, dnsmessage.RCodeSuccess, []string{"172.17.0.3", "fd00::3"}, ""},
+		// NODATA, the name exists
+		{"web.docker.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil, ""},
+		{"v6.docker.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, ""},
+		{"v6.docker.", dnsmessage.TypeALL, dnsmessage.RCodeSuccess, []string{"fd00::4"}, ""},
+		{"missing.docker.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, ""},
+		{"web.example.", dnsmessage.TypeA, dnsmessage.RCodeRefused, nil, ""},
+		{"2.0.17.172.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, nil, "web.docker."},
+		{"9.0.17.172.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, nil, ""},
+	}
+	for _, tt := range tests {
+		r := query(t, res, tt.name, tt.typ)
+		if r.RCode != tt.rcode {
+			t.Errorf("%s %v: rcode %v, want %v", tt.name, tt.typ, r.RCode, tt.rcode)
+			continue
+		}
+		if tt.ptr != "" {
+			if len(r.Answers) != 1 || r.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String() != tt.ptr {
+				t.Errorf("%s: answers %v, want %s", tt.name, r.Answers, tt.ptr)
+			}
+			continue
+		}
+		if got := answerIPs(r); !reflect.DeepEqual(got, tt.ips) {
+			t.Errorf("%s %v: ips %v, want %v", tt.name, tt.typ, got, tt.ips)
+		}
+		if tt.rcode != dnsmessage.RCodeRefused && tt.typ != dnsmessage.TypePTR && !r.Authoritative {
+			t.Errorf("%s %v: not authoritative", tt.name, tt.typ)
+		}
+	}
+}
+
+// The ttl label applies whichever name the container is found by, without
+// asking docker again.
+func TestLabelTTL(t *testing.T) {
+	fake := newFakeDocker(
+		ctr("web", "aaaa1111", ep("front", "172.18.0.2", "", "webalias")).label("dcdns.ttl", "5"),
+		ctr("db", "bbbb2222", ep("front", "172.18.0.3", "")).label("dcdns.ttl", "x"),
+	)
+	cfg := testConfig()
+	cfg.TTLLabel = "dcdns.ttl"
+	res := New(fake, cfg)
+	tests := []struct {
+		name string
+		ttl  uint32
+	}{
+		{"web.docker.", 5},
+		{"webalias.docker.", 5},
+		{"db.docker.", 60},
+	}
+	for _, tt := range tests {
+		query(t, res, tt.name, dnsmessage.TypeA)
+		before, _ := fake.calls()
+		r := query(t, res, tt.name, dnsmessage.TypeA)
+		after, _ := fake.calls()
+		if len(r.Answers) != 1 || r.Answers[0].Header.TTL != tt.ttl {
+			t.Errorf("%s: answers %v, want one with ttl %d", tt.name, r.Answers, tt.ttl)
+		}
+		// container names are cached, the alias is inspected as a name once
+		if after-before > 1 {
+			t.Errorf("%s: %d inspects, want at most 1", tt.name, after-before)
+		}
+	}
+}
+
+// Names that exist get NODATA for the types they have no records of.
+func TestNoData(t *testing.T) {
+	res := New(newFakeDocker(ctr("web", "aaaa1111", ep("bridge", "172.17.0.2", ""))), testConfig())
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeMX, 65, 257, dnsmessage.TypeNS} {
+		if r := query(t, res, "web.docker.", typ); r.RCode != dnsmessage.RCodeSuccess || len(r.Answers) != 0 || !r.Authoritative {
+			t.Errorf("web %v: rcode %v, %d answers, want NODATA", typ, r.RCode, len(r.Answers))
+		}
+		if r := query(t, res, "missing.docker.", typ); r.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("missing %v: rcode %v, want NXDOMAIN", typ, r.RCode)
+		}
+	}
+}
+
+// Names are matched case-insensitively but the question and the answers keep
+// the case it was asked in.
+func TestMixedCase(t *testing.T) {
+	res := New(newFakeDocker(ctr("web", "aaaa1111", ep("bridge", "172.17.0.2", ""))), testConfig())
+	const name = "WeB.DoCkEr."
+	r := query(t, res, name, dnsmessage.TypeA)
+	if r.RCode != dnsmessage.RCodeSuccess || len(r.Answers) != 1 {
+		t.Fatalf("rcode %v, %d answers, want one answer", r.RCode, len(r.Answers))
+	}
+	if got := r.Questions[0].Name.String(); got != name {
+		t.Errorf("question %s, want %s", got, name)
+	}
+	if got := r.Answers[0].Header.Name.String(); got != name {
+		t.Errorf("answer for %s, want %s", got, name)
+	}
+}
+
+// The replicas of a compose service all answer for service.project, each of
+// them first in turn.
+func TestServiceReplicas(t *testing.T) {
+	var replicas []*fakeContainer
+	for i, ip := range []string{"172.18.0.2", "172.18.0.3", "172.18.0.4"} {
+		c := ctr(fmt.Sprintf("shop-web-%d", i+1), fmt.Sprintf("%d000aaaa", i+1), ep("shop_default", ip, ""))
+		replicas = append(replicas, c.label(composeProjectLabel, "shop").label(composeServiceLabel, "web"))
+	}
+	cfg := testConfig()
+	cfg.Compose = true
+	res := New(newFakeDocker(replicas...), cfg)
+	want := []string{"172.18.0.2", "172.18.0.3", "172.18.0.4"}
+	first := map[string]bool{}
+	for i := 0; i < len(want); i++ {
+		r := query(t, res, "web.shop.docker.", dnsmessage.TypeA)
+		if got := sortedIPs(r); !reflect.DeepEqual(got, want) {
+			t.Fatalf("query %d: ips %v, want %v", i, got, want)
+		}
+		first[answerIPs(r)[0]] = true
+	}
+	if len(first) != len(want) {
+		t.Errorf("%d replicas answered first, want %d", len(first), len(want))
+	}
+}
+
+// Containers that exited have no address to reach, they don't exist as far
+// as queries go.
+func TestExitedContainer(t *testing.T) {
+	exited := ctr("old", "dddd4444", ep("bridge", "172.17.0.9", ""))
+	exited.stopped = true
+	res := New(newFakeDocker(exited), testConfig())
+	for _, name := range []string{"old.docker.", "dddd4444.docker."} {
+		for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			if r := query(t, res, name, typ); r.RCode != dnsmessage.RCodeNameError || len(r.Answers) != 0 {
+				t.Errorf("%s %v: rcode %v, %d answers, want NXDOMAIN", name, typ, r.RCode, len(r.Answers))
+			}
+		}
+	}
+}
+
+// Names sent without the trailing dot or with empty labels are matched in
+// canonical form.
+func TestCanonicalName(t *testing.T) {
+	res := New(newFakeDocker(ctr("mycontainer", "aaaa1111", ep("bridge", "172.17.0.2", ""))), testConfig())
+	for _, name := range []string{"mycontainer.docker.", "mycontainer.docker", "mycontainer..docker.", "MyContainer.docker..", ".mycontainer.docker"} {
+		cn := canonicalName(name)
+		if cn != "mycontainer.docker." {
+			t.Errorf("%q: canonical %q, want mycontainer.docker.", name, cn)
+			continue
+		}
+		n, suffix, ok := res.splitName(cn)
+		if !ok || n != "mycontainer" || suffix != "docker" {
+			t.Errorf("%q: split into %q and %q, %v", name, n, suffix, ok)
+			continue
+		}
+		if ips, err := res.ResolveContainerName(n); err != nil || len(ips) != 1 {
+			t.Errorf("%q: %v, %v, want one address", name, ips, err)
+		}
+	}
+}
+
+// An id prefix two containers share gets the answer the ambiguous policy
+// says.
+func TestAmbiguousPrefix(t *testing.T) {
+	exited := ctr("old", "ef001111", ep("bridge", "172.17.0.9", ""))
+	exited.stopped = true
+	fake := newFakeDocker(
+		ctr("web", "abcd1111", ep("bridge", "172.17.0.2", "")),
+		ctr("db", "abcd2222", ep("bridge", "172.17.0.3", "")),
+		// has abcd in its id, but doesn't start with it
+		ctr("cache", "99abcd00", ep("bridge", "172.17.0.4", "")),
+		ctr("app", "ef002222", ep("bridge", "172.17.0.5", "")),
+		exited,
+	)
+	tests := []struct {
+		policy string
+		rcode  dnsmessage.RCode
+		ips    []string
+	}{
+		{"", dnsmessage.RCodeSuccess, []string{"172.17.0.2", "172.17.0.3"}},
+		{AmbiguousAll, dnsmessage.RCodeSuccess, []string{"172.17.0.2", "172.17.0.3"}},
+		{AmbiguousNXDomain, dnsmessage.RCodeNameError, nil},
+		{AmbiguousServFail, dnsmessage.RCodeServerFailure, nil},
+	}
+	for _, prebuilt := range []bool{false, true} {
+		for _, tt := range tests {
+			cfg := testConfig()
+			cfg.Ambiguous = tt.policy
+			if prebuilt {
+				cfg.Refresh = time.Minute
+			}
+			res := New(fake, cfg)
+			r := query(t, res, "abcd.docker.", dnsmessage.TypeA)
+			if r.RCode != tt.rcode {
+				t.Errorf("%q, prebuilt %v: rcode %v, want %v", tt.policy, prebuilt, r.RCode, tt.rcode)
+			}
+			if got := sortedIPs(r); !reflect.DeepEqual(got, tt.ips) {
+				t.Errorf("%q, prebuilt %v: ips %v, want %v", tt.policy, prebuilt, got, tt.ips)
+			}
+			// docker finds a prefix of a running and an exited container
+			// ambiguous too, only the running one has an address; the
+			// index only has the running one
+			r = query(t, res, "ef00.docker.", dnsmessage.TypeA)
+			if tt.rcode == dnsmessage.RCodeSuccess || prebuilt {
+				if got := answerIPs(r); !reflect.DeepEqual(got, []string{"172.17.0.5"}) {
+					t.Errorf("%q, prebuilt %v: ef00 ips %v, want 172.17.0.5", tt.policy, prebuilt, got)
+				}
+			} else if r.RCode != tt.rcode {
+				t.Errorf("%q, prebuilt %v: ef00 rcode %v, want %v", tt.policy, prebuilt, r.RCode, tt.rcode)
+			}
+			// a prefix of one of them isn't ambiguous
+			if ips := answerIPs(query(t, res, "abcd1.docker.", dnsmessage.TypeA)); !reflect.DeepEqual(ips, []string{"172.17.0.2"}) {
+				t.Errorf("%q, prebuilt %v: abcd1 ips %v, want 172.17.0.2", tt.policy, prebuilt, ips)
+			}
+		}
+	}
+}
+
+// Inspects failing for any reason but the container not being there or the
+// name being an ambiguous id prefix are retried, up to InspectRetries times.
+func TestInspectRetries(t *testing.T) {
+	transient := errors.New("connection reset by peer")
+	tests := []struct {
+		name     string
+		retries  int
+		errs     []error
+		rcode    dnsmessage.RCode
+		inspects int
+	}{
+		{"web", 1, []error{transient}, dnsmessage.RCodeSuccess, 2},
+		{"web", 3, []error{transient, transient}, dnsmessage.RCodeSuccess, 3},
+		{"web", 0, []error{transient}, dnsmessage.RCodeServerFailure, 1},
+		{"web", 2, []error{transient, transient, transient}, dnsmessage.RCodeServerFailure, 3},
+		{"nope", 3, nil, dnsmessage.RCodeNameError, 1},
+		// an ambiguous prefix, docker fails it with a plain error
+		{"bbbb", 3, nil, dnsmessage.RCodeSuccess, 1},
+	}
+	for _, tt := range tests {
+		fake := newFakeDocker(
+			ctr("web", "aaaa1111", ep("bridge", "172.17.0.2", "")),
+			ctr("db1", "bbbb1111", ep("bridge", "172.17.0.3", "")),
+			ctr("db2", "bbbb2222", ep("bridge", "172.17.0.4", "")),
+		)
+		fake.inspectErrs = tt.errs
+		cfg := testConfig()
+		cfg.InspectRetries = tt.retries
+		r := query(t, New(fake, cfg), tt.name+".docker.", dnsmessage.TypeA)
+		inspects, _ := fake.calls()
+		if r.RCode != tt.rcode || inspects != tt.inspects {
+			t.Errorf("%s, %d retries, %d errors: rcode %v after %d inspects, want %v after %d",
+				tt.name, tt.retries, len(tt.errs), r.RCode, inspects, tt.rcode, tt.inspects)
+		}
+	}
+}
+
+// Names after the label prefix resolve to every container with the label
+// set to the rest of the name, from the index.
+func TestLabelValue(t *testing.T) {
+	fake := newFakeDocker(
+		ctr("db1", "aaaa1111", ep("bridge", "172.17.0.2", "")).label("Tier", "DB"),
+		ctr("db2", "bbbb2222", ep("bridge", "172.17.0.3", "")).label("Tier", "db"),
+		ctr("web", "cccc3333", ep("bridge", "172.17.0.4", "")).label("Tier", "web").label("tier", "db"),
+	)
+	tests := []struct {
+		prefix, name string
+		rcode        dnsmessage.RCode
+		ips          []string
+	}{
+		{"Tier-", "tier-db.docker.", dnsmessage.RCodeSuccess, []string{"172.17.0.2", "172.17.0.3"}},
+		{"Tier__", "tier__web.docker.", dnsmessage.RCodeSuccess, []string{"172.17.0.4"}},
+		{"tier-", "tier-db.docker.", dnsmessage.RCodeSuccess, []string{"172.17.0.4"}},
+		{"Tier-", "tier-cache.docker.", dnsmessage.RCodeNameError, nil},
+		{"Tier-", "tier-.docker.", dnsmessage.RCodeNameError, nil},
+		// no label name
+		{"-", "-db.docker.", dnsmessage.RCodeNameError, nil},
+	}
+	for _, tt := range tests {
+		cfg := testConfig()
+		cfg.LabelPrefix = tt.prefix
+		res := New(fake, cfg)
+		_, before := fake.calls()
+		for i := 0; i < 2; i++ {
+			r := query(t, res, tt.name, dnsmessage.TypeA)
+			if r.RCode != tt.rcode {
+				t.Errorf("%s %s: rcode %v, want %v", tt.prefix, tt.name, r.RCode, tt.rcode)
+			}
+			if got := sortedIPs(r); !reflect.DeepEqual(got, tt.ips) {
+				t.Errorf("%s %s: ips %v, want %v", tt.prefix, tt.name, got, tt.ips)
+			}
+		}
+		if _, after := fake.calls(); after-before > 1 {
+			t.Errorf("%s %s: %d lists, want the index built once", tt.prefix, tt.name, after-before)
+		}
+	}
+}
+
+func TestLabelPrefixKey(t *testing.T) {
+	for prefix, want := range map[string]string{"role-": "role", "Role__": "Role", "com.example.role.": "com.example.role", "role": "role", "-": ""} {
+		if got := labelPrefixKey(prefix); got != want {
+			t.Errorf("%q: %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+// Docker names are case-sensitive, queries for them aren't.
+func TestMixedCaseContainer(t *testing.T) {
+	fake := newFakeDocker(ctr("MyApp", "aaaa1111", ep("bridge", "172.17.0.2", "")))
+	res := New(fake, testConfig())
+	for _, name := range []string{"MyApp.docker.", "myapp.docker.", "MYAPP.docker."} {
+		if ips := answerIPs(query(t, res, name, dnsmessage.TypeA)); !reflect.DeepEqual(ips, []string{"172.17.0.2"}) {
+			t.Errorf("%s: ips %v, want 172.17.0.2", name, ips)
+		}
+	}
+	if ips, err := res.ResolveContainerName("MyApp"); err != nil || len(ips) != 1 {
+		t.Errorf("MyApp: %v, %v, want one address", ips, err)
+	}
+}
@@ -0,0 +1,38 @@
+package resolver
+
+import "sync"
+
+// maxRoundRobinNames bounds the names tracked, the counters start over once
+// it's reached.
+const maxRoundRobinNames = 10000
+
+// roundRobin hands out a rotating offset per name so clients that only use
+// the first record of an answer spread over all of them.
+type roundRobin struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func newRoundRobin() *roundRobin {
+	return &roundRobin{next: make(map[string]int)}
+}
+
+func (rr *roundRobin) offset(name string) int {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if len(rr.next) >= maxRoundRobinNames {
+		rr.next = make(map[string]int)
+	}
+	n := rr.next[name]
+	rr.next[name] = n + 1
+	return n
+}
+
+// rotate returns ips rotated left by n.
+func rotate[T any](ips []T, n int) []T {
+	if len(ips) < 2 {
+		return ips
+	}
+	n %= len(ips)
+	return append(ips[n:len(ips):len(ips)], ips[:n]...)
+}
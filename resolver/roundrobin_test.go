@@ -0,0 +1,46 @@
+package resolver
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRotate(t *testing.T) {
+	ips := []string{"a", "b", "c"}
+	rr := newRoundRobin()
+	want := [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}}
+	for i, w := range want {
+		if got := rotate(ips, rr.offset("web")); !reflect.DeepEqual(got, w) {
+			t.Errorf("call %d: %v, want %v", i, got, w)
+		}
+	}
+	if !reflect.DeepEqual(ips, []string{"a", "b", "c"}) {
+		t.Errorf("rotate changed its argument to %v", ips)
+	}
+	// names rotate independently
+	if n := rr.offset("db"); n != 0 {
+		t.Errorf("first offset of another name %d, want 0", n)
+	}
+}
+
+// A container on several networks answers with each of its addresses first
+// in turn, on successive queries.
+func TestReplyRotates(t *testing.T) {
+	res := New(newFakeDocker(ctr("web", "aaaa1111",
+		ep("front", "172.18.0.2", ""),
+		ep("back", "172.19.0.2", ""),
+	)), testConfig())
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		ips := answerIPs(query(t, res, "web.docker.", dnsmessage.TypeA))
+		if len(ips) != 2 {
+			t.Fatalf("query %d: ips %v, want 2", i, ips)
+		}
+		firsts = append(firsts, ips[0])
+	}
+	if firsts[0] == firsts[1] || firsts[0] != firsts[2] || firsts[1] != firsts[3] {
+		t.Errorf("first answers %v, want them alternating", firsts)
+	}
+}
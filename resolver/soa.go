@@ -0,0 +1,123 @@
+package resolver
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// SOA holds the timers of the zones' SOA records, in seconds.
+type SOA struct {
+	Refresh, Retry, Expire, MinTTL uint32
+}
+
+// serial is the zone serial, it starts at the unix time so it keeps
+// growing across restarts and is bumped on every container event.
+type serial struct {
+	n uint32
+}
+
+func newSerial() *serial {
+	return &serial{n: uint32(time.Now().Unix())}
+}
+
+func (s *serial) bump() {
+	atomic.AddUint32(&s.n, 1)
+}
+
+func (s *serial) get() uint32 {
+	return atomic.LoadUint32(&s.n)
+}
+
+// apex returns the suffix a lowercased fully qualified name is the apex of.
+func (res *Resolver) apex(fqdn string) (string, bool) {
+	for _, sf := range res.zone.Load().suffixes {
+		if fqdn == sf+"." {
+			return sf, true
+		}
+	}
+	return "", false
+}
+
+// soa returns the SOA record of the zone named suffix.
+func (res *Resolver) soa(suffix string) (dnsmessage.Resource, error) {
+	zone, err := dnsmessage.NewName(suffix + ".")
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	ns, err := res.nameServer(suffix)
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	mbox, err := dnsmessage.NewName("hostmaster." + suffix + ".")
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	return res.answer(zone, dnsmessage.TypeSOA, &dnsmessage.SOAResource{
+		NS:      ns,
+		MBox:    mbox,
+		Serial:  res.serial.get(),
+		Refresh: res.soaTimers.Refresh,
+		Retry:   res.soaTimers.Retry,
+		Expire:  res.soaTimers.Expire,
+		MinTTL:  res.soaTimers.MinTTL,
+	}), nil
+}
+
+// nameServer returns the name of this server, by default dcdns under the
+// zone.
+func (res *Resolver) nameServer(suffix string) (dnsmessage.Name, error) {
+	if res.nsName != "" {
+		return dnsmessage.NewName(strings.TrimSuffix(res.nsName, ".") + ".")
+	}
+	return dnsmessage.NewName("dcdns." + suffix + ".")
+}
+
+// replyApex answers queries for the zone apex, its SOA and NS records and
+// the addresses given by Config.ApexIPs exist.
+func (res *Resolver) replyApex(r *dnsmessage.Message, suffix string) (*dnsmessage.Message, error) {
+	r.RCode = dnsmessage.RCodeSuccess
+	q := r.Questions[0]
+	r.Answers = nil
+	if q.Type == dnsmessage.TypeSOA || q.Type == dnsmessage.TypeALL {
+		soa, err := res.soa(suffix)
+		if err != nil {
+			return nil, err
+		}
+		soa.Header.Name = q.Name
+		r.Answers = append(r.Answers, soa)
+	}
+	if q.Type == dnsmessage.TypeNS || q.Type == dnsmessage.TypeALL {
+		ns, err := res.nameServer(suffix)
+		if err != nil {
+			return nil, err
+		}
+		r.Answers = append(r.Answers, res.answer(q.Name, dnsmessage.TypeNS, &dnsmessage.NSResource{NS: ns}))
+	}
+	r.Answers = append(r.Answers, res.addressRecords(q, res.apexIPs)...)
+	return res.negative(r, suffix)
+}
+
+// negative adds the zone's SOA to the authority section of NXDOMAIN and
+// NODATA replies. Resolvers cache the negative answer for the lesser of its
+// ttl and minimum (RFC 2308), both are the negative ttl.
+func (res *Resolver) negative(r *dnsmessage.Message, suffix string) (*dnsmessage.Message, error) {
+	nodata := r.RCode == dnsmessage.RCodeSuccess && len(r.Answers) == 0
+	if r.RCode != dnsmessage.RCodeNameError && !nodata {
+		return r, nil
+	}
+	soa, err := res.soa(suffix)
+	if err != nil {
+		return nil, err
+	}
+	ttl := res.nxdomainTTL
+	if ttl == 0 {
+		ttl = res.soaTimers.MinTTL
+	}
+	soa.Header.TTL = ttl
+	soa.Body.(*dnsmessage.SOAResource).MinTTL = ttl
+	r.Authorities = append(r.Authorities, soa)
+	return r, nil
+}
@@ -0,0 +1,63 @@
+package resolver
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// replySRV answers _service._proto.name queries with the matching port if
+// the container name resolves to exposes it, any of them if several. The
+// service may be a name known to the system (e.g. _http) or a port number
+// (e.g. _8080). The target is name itself.
+func (res *Resolver) replySRV(r *dnsmessage.Message, name, suffix string) (*dnsmessage.Message, error) {
+	q := r.Questions[0]
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) != 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		r.RCode = dnsmessage.RCodeNameError
+		return r, nil
+	}
+	service, proto, container := labels[0][1:], labels[1][1:], labels[2]
+	m, err := res.lookupName(container)
+	if err != nil {
+		return lookupFailed(r, err)
+	}
+	r.RCode = dnsmessage.RCodeSuccess
+	if proto != "tcp" && proto != "udp" {
+		return r, nil
+	}
+	port, err := strconv.Atoi(service)
+	if err != nil {
+		if port, err = net.LookupPort(proto, service); err != nil {
+			return r, nil
+		}
+	}
+	p, err := nat.NewPort(proto, strconv.Itoa(port))
+	if err != nil {
+		return r, nil
+	}
+	if !exposes(m.containers, p) {
+		return r, nil
+	}
+	target, err := dnsmessage.NewName(encodeName(container) + "." + suffix + ".")
+	if err != nil {
+		return nil, err
+	}
+	r.Answers = []dnsmessage.Resource{res.answer(q.Name, q.Type, &dnsmessage.SRVResource{Port: uint16(port), Target: target})}
+	return r, nil
+}
+
+// exposes reports whether any of containers exposes port.
+func exposes(containers []found, port nat.Port) bool {
+	for _, c := range containers {
+		for _, p := range c.ports {
+			if p == port {
+				return true
+			}
+		}
+	}
+	return false
+}
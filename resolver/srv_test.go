@@ -0,0 +1,49 @@
+package resolver
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestSRVNames(t *testing.T) {
+	web := ctr("web", "aaaa1111", ep("front", "172.18.0.2", "", "webalias")).
+		label(composeProjectLabel, "shop").label(composeServiceLabel, "www")
+	web.ports = []string{"80/tcp"}
+	fake := newFakeDocker(web)
+	cfg := testConfig()
+	cfg.Compose = true
+	res := New(fake, cfg)
+	tests := []struct {
+		name   string
+		rcode  dnsmessage.RCode
+		target string
+	}{
+		{"_http._tcp.web.docker.", dnsmessage.RCodeSuccess, "web.docker."},
+		{"_80._tcp.webalias.docker.", dnsmessage.RCodeSuccess, "webalias.docker."},
+		{"_http._tcp.www.shop.docker.", dnsmessage.RCodeSuccess, "www.shop.docker."},
+		{"_https._tcp.web.docker.", dnsmessage.RCodeSuccess, ""},
+		{"_http._tcp.missing.docker.", dnsmessage.RCodeNameError, ""},
+	}
+	for _, tt := range tests {
+		r := query(t, res, tt.name, dnsmessage.TypeSRV)
+		if r.RCode != tt.rcode {
+			t.Errorf("%s: rcode %v, want %v", tt.name, r.RCode, tt.rcode)
+			continue
+		}
+		if tt.target == "" {
+			if len(r.Answers) != 0 {
+				t.Errorf("%s: %d answers, want none", tt.name, len(r.Answers))
+			}
+			continue
+		}
+		if len(r.Answers) != 1 {
+			t.Errorf("%s: %d answers, want 1", tt.name, len(r.Answers))
+			continue
+		}
+		srv := r.Answers[0].Body.(*dnsmessage.SRVResource)
+		if srv.Port != 80 || srv.Target.String() != tt.target {
+			t.Errorf("%s: %d %s, want 80 %s", tt.name, srv.Port, srv.Target, tt.target)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+const (
+	// managerRecheck is how long a node found not to be a swarm manager
+	// isn't asked about services again.
+	managerRecheck = time.Minute
+	// maxServiceNames bounds the service lookups cached, they're all
+	// dropped once there are as many.
+	maxServiceNames = 10000
+)
+
+// serviceCache remembers the virtual ips of the names looked up as swarm
+// services, none for those that aren't, and whether the node is a manager.
+type serviceCache struct {
+	now func() time.Time
+
+	mu         sync.Mutex
+	entries    map[string]serviceEntry
+	notManager time.Time // until when services aren't looked up
+}
+
+type serviceEntry struct {
+	nets    []*network.EndpointSettings // nil if name isn't a service
+	expires time.Time
+}
+
+func newServiceCache(now func() time.Time) *serviceCache {
+	return &serviceCache{now: now, entries: make(map[string]serviceEntry)}
+}
+
+// get returns the cached lookup of name, ok is false if there's none. No
+// name is a service while the node isn't a manager.
+func (c *serviceCache) get(name string) ([]*network.EndpointSettings, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Before(c.notManager) {
+		return nil, true
+	}
+	e, ok := c.entries[name]
+	if !ok || !now.Before(e.expires) {
+		return nil, false
+	}
+	return e.nets, true
+}
+
+func (c *serviceCache) set(name string, nets []*network.EndpointSettings, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxServiceNames {
+		c.entries = make(map[string]serviceEntry)
+	}
+	c.entries[name] = serviceEntry{nets: nets, expires: c.now().Add(ttl)}
+}
+
+// setNotManager stops looking services up for managerRecheck.
+func (c *serviceCache) setNotManager() {
+	c.mu.Lock()
+	c.notManager = c.now().Add(managerRecheck)
+	c.mu.Unlock()
+}
+
+func (c *serviceCache) flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]serviceEntry)
+	c.notManager = time.Time{}
+	c.mu.Unlock()
+}
+
+// notManager reports whether err is docker refusing to look services up
+// because the node isn't a swarm manager. The client passes the daemon's 503
+// on as is, only its message tells.
+func notManager(err error) bool {
+	return errdefs.IsUnavailable(err) || strings.Contains(err.Error(), "This node is not a swarm manager")
+}
+
+// serviceVIPs returns an endpoint per virtual ip of the named swarm service.
+// Names that aren't services, services without virtual ips (dnsrr endpoint
+// mode) and nodes that aren't swarm managers give a not found error so the
+// name is looked up as a container instead. Lookups are cached for the
+// answer ttl, a node that isn't a manager is asked again after
+// managerRecheck.
+func (res *Resolver) serviceVIPs(name string) ([]*network.EndpointSettings, error) {
+	name = strings.ToLower(name)
+	if nets, ok := res.services.get(name); ok {
+		if nets == nil {
+			return nil, errNotFound(name)
+		}
+		return nets, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), res.timeout)
+	defer cancel()
+	ttl := time.Duration(res.zone.Load().ttl) * time.Second
+	svc, _, err := res.cl.ServiceInspectWithRaw(ctx, name, types.ServiceInspectOptions{})
+	if err != nil {
+		switch {
+		case errdefs.IsNotFound(err):
+			res.services.set(name, nil, ttl)
+		case notManager(err):
+			res.services.setNotManager()
+		default:
+			return nil, err
+		}
+		return nil, errNotFound(name)
+	}
+	var nets []*network.EndpointSettings
+	for _, vip := range svc.Endpoint.VirtualIPs {
+		ip, _, err := net.ParseCIDR(vip.Addr)
+		if err != nil {
+			continue
+		}
+		if ip.To4() != nil {
+			nets = append(nets, &network.EndpointSettings{NetworkID: vip.NetworkID, IPAddress: ip.String()})
+		} else {
+			nets = append(nets, &network.EndpointSettings{NetworkID: vip.NetworkID, GlobalIPv6Address: ip.String()})
+		}
+	}
+	res.services.set(name, nets, ttl)
+	if len(nets) == 0 {
+		return nil, errNotFound(name)
+	}
+	return nets, nil
+}
@@ -0,0 +1,47 @@
+package resolver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestServiceVIPs(t *testing.T) {
+	// what the client makes of the daemon's 503
+	notManagerErr := errors.New("Error response from daemon: This node is not a swarm manager. Use \"docker swarm init\" or \"docker swarm join\" to connect this node to swarm and try again.")
+	tests := []struct {
+		desc       string
+		serviceErr error
+		name       string
+		ips        []string
+		services   int // inspected over both queries
+	}{
+		{"service", nil, "api.docker.", []string{"10.0.1.5"}, 1},
+		{"container", nil, "web.docker.", []string{"172.17.0.2"}, 1},
+		{"not a manager", notManagerErr, "web.docker.", []string{"172.17.0.2"}, 1},
+		{"not a manager, service name", notManagerErr, "api.docker.", nil, 1},
+	}
+	for _, tt := range tests {
+		fake := newFakeDocker(ctr("web", "aaaa1111", ep("bridge", "172.17.0.2", "")))
+		fake.services = map[string]swarm.Service{"api": {Endpoint: swarm.Endpoint{VirtualIPs: []swarm.EndpointVirtualIP{{NetworkID: "ingress", Addr: "10.0.1.5/24"}}}}}
+		fake.serviceErr = tt.serviceErr
+		cfg := testConfig()
+		cfg.Swarm = true
+		res := New(fake, cfg)
+		for i := 0; i < 2; i++ {
+			r := query(t, res, tt.name, dnsmessage.TypeA)
+			if got := answerIPs(r); !reflect.DeepEqual(got, tt.ips) {
+				t.Errorf("%s, query %d: rcode %v, ips %v, want %v", tt.desc, i, r.RCode, got, tt.ips)
+			}
+		}
+		fake.mu.Lock()
+		services := fake.serviceInspects
+		fake.mu.Unlock()
+		if services != tt.services {
+			t.Errorf("%s: %d service inspects, want %d", tt.desc, services, tt.services)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package resolver
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxTXTString is the longest character string a TXT record holds.
+const maxTXTString = 255
+
+// replyTXT answers TXT queries with the metadata of the container name
+// resolves to, the first one if several: one key=value record (RFC 1464)
+// each for the image, the status and the labels starting with the
+// configured prefix. Names of swarm services and wildcard ips get NODATA.
+func (res *Resolver) replyTXT(r *dnsmessage.Message, name string) (*dnsmessage.Message, error) {
+	q := r.Questions[0]
+	m, err := res.lookupName(name)
+	if err != nil {
+		return lookupFailed(r, err)
+	}
+	r.RCode = dnsmessage.RCodeSuccess
+	r.Answers = nil
+	if len(m.containers) == 0 {
+		return r, nil
+	}
+	c := m.containers[0]
+	attrs := []string{"image=" + c.image, "status=" + c.status}
+	if res.txtLabels != "" {
+		var labels []string
+		for k, v := range c.labels {
+			if strings.HasPrefix(k, res.txtLabels) {
+				labels = append(labels, "label:"+k+"="+v)
+			}
+		}
+		sort.Strings(labels)
+		attrs = append(attrs, labels...)
+	}
+	for _, a := range attrs {
+		r.Answers = append(r.Answers, res.answer(q.Name, dnsmessage.TypeTXT, &dnsmessage.TXTResource{TXT: splitTXT(a)}))
+	}
+	return r, nil
+}
+
+// idPrefix is the label TXT queries put before a container name to get its
+// full id, with Config.TXTID: id.web.docker. for the container web.
+const idPrefix = "id."
+
+// replyID answers TXT queries for id.<name> with the id of the container
+// name resolves to, as a single string, a record each if several.
+func (res *Resolver) replyID(r *dnsmessage.Message, name string) (*dnsmessage.Message, error) {
+	q := r.Questions[0]
+	m, err := res.lookupName(name)
+	if err != nil {
+		return lookupFailed(r, err)
+	}
+	r.RCode = dnsmessage.RCodeSuccess
+	r.Answers = nil
+	for _, c := range m.containers {
+		r.Answers = append(r.Answers, res.answer(q.Name, dnsmessage.TypeTXT, &dnsmessage.TXTResource{TXT: []string{c.id}}))
+	}
+	return r, nil
+}
+
+// splitTXT splits s into character strings short enough for a TXT record,
+// readers concatenate them back.
+func splitTXT(s string) []string {
+	var parts []string
+	for len(s) > maxTXTString {
+		parts = append(parts, s[:maxTXTString])
+		s = s[maxTXTString:]
+	}
+	return append(parts, s)
+}
@@ -0,0 +1,44 @@
+package resolver
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func txtStrings(r *dnsmessage.Message) []string {
+	var txt []string
+	for _, a := range r.Answers {
+		if b, ok := a.Body.(*dnsmessage.TXTResource); ok {
+			txt = append(txt, b.TXT...)
+		}
+	}
+	return txt
+}
+
+// TXT queries find containers by any of their names, like address ones.
+func TestTXTNames(t *testing.T) {
+	fake := newFakeDocker(
+		ctr("web", "aaaa1111", ep("front", "172.18.0.2", "", "webalias")).label("dcdns.name", "site").label("dcdns.tier", "front"),
+	)
+	cfg := testConfig()
+	cfg.NameLabel = "dcdns.name"
+	cfg.TXTLabels = "dcdns.tier"
+	cfg.TXTID = true
+	res := New(fake, cfg)
+	want := []string{"image=img/web", "status=running", "label:dcdns.tier=front"}
+	for _, name := range []string{"web", "webalias", "site", "web.front"} {
+		r := query(t, res, name+".docker.", dnsmessage.TypeTXT)
+		if got := txtStrings(r); r.RCode != dnsmessage.RCodeSuccess || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: rcode %v, %q, want %q", name, r.RCode, got, want)
+		}
+		r = query(t, res, "id."+name+".docker.", dnsmessage.TypeTXT)
+		if got := txtStrings(r); !reflect.DeepEqual(got, []string{"aaaa1111"}) {
+			t.Errorf("id.%s: rcode %v, %q", name, r.RCode, got)
+		}
+	}
+	if r := query(t, res, "missing.docker.", dnsmessage.TypeTXT); r.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("missing: rcode %v, want NXDOMAIN", r.RCode)
+	}
+}
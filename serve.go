@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type packet struct {
+	conn net.PacketConn
+	m    []byte
+	addr net.Addr
+}
+
+// listenNetworks returns the udp and tcp networks to listen on ip with:
+// family is udp4, udp6 or udp (dual stack), or empty to follow ip's family.
+func listenNetworks(ip net.IP, family string) (string, string) {
+	if family == "" {
+		family = "udp6"
+		if ip.To4() != nil {
+			family = "udp4"
+		}
+	}
+	return family, "tcp" + strings.TrimPrefix(family, "udp")
+}
+
+// listen opens a udp socket and a tcp listener on port for each of ips.
+func listen(ips []net.IP, port int, family string) ([]*net.UDPConn, []*net.TCPListener, error) {
+	var (
+		conns []*net.UDPConn
+		lns   []*net.TCPListener
+	)
+	closeAll := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		udp, tcp := listenNetworks(ip, family)
+		conn, err := net.ListenUDP(udp, &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("can't listen on %s %s: %w", udp, addr, err)
+		}
+		conns = append(conns, conn)
+		ln, err := net.ListenTCP(tcp, &net.TCPAddr{IP: ip, Port: port})
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("can't listen on %s %s: %w", tcp, addr, err)
+		}
+		lns = append(lns, ln)
+		slog.Info("listening", "addr", addr, "udp", udp, "tcp", tcp)
+	}
+	return conns, lns, nil
+}
+
+// defaultAllow are the networks queries are accepted from unless told
+// otherwise: loopback and private addresses.
+const defaultAllow = "127.0.0.0/8,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,::1/128,fc00::/7"
+
+// parseCIDRs parses a comma separated list of networks.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// addrIP returns the ip of a client address, nil if it has none.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// allowed reports whether queries from ip are answered. Clients without an
+// ip can't be matched against -allow and aren't.
+func (s *server) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range *s.allow.Load() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// underLimit reports whether ip hasn't exceeded its query rate. Clients
+// without an ip share one.
+func (s *server) underLimit(ip net.IP) bool {
+	return s.limit == nil || s.limit.allow(ip)
+}
+
+// serve answers queries on all sockets until ctx is done and they're closed.
+// UDP queries are handed to a fixed pool of workers, packets arriving while
+// all of them are busy are dropped. Any net.PacketConn and net.Listener do,
+// packet conns giving *net.UDPAddr addresses get udp size limits applied.
+// See allowed for clients with other addresses.
+func (s *server) serve(ctx context.Context, conns []net.PacketConn, lns []net.Listener) {
+	queue := make(chan packet, s.workers)
+	for i := 0; i < s.workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for p := range queue {
+				s.replyUDP(p)
+			}
+		}()
+	}
+	var loops sync.WaitGroup
+	for _, conn := range conns {
+		loops.Add(1)
+		go func(conn net.PacketConn) {
+			defer loops.Done()
+			s.serveUDP(ctx, conn, queue)
+		}(conn)
+	}
+	for _, ln := range lns {
+		loops.Add(1)
+		go func(ln net.Listener) {
+			defer loops.Done()
+			s.serveTCP(ctx, ln)
+		}(ln)
+	}
+	s.serving.Store(true)
+	loops.Wait()
+	s.serving.Store(false)
+	close(queue)
+	s.wg.Wait()
+}
+
+// serveUDP queues the queries read from conn until ctx is done and conn is
+// closed.
+func (s *server) serveUDP(ctx context.Context, conn net.PacketConn, queue chan<- packet) {
+	// one byte more tells oversized datagrams, cut to the buffer, apart
+	b := make([]byte, s.maxUDP+1)
+	for {
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("socket read error", "err", err)
+			continue
+		}
+		// empty datagrams can't be answered, not even with FORMERR
+		if n == 0 {
+			continue
+		}
+		if n > s.maxUDP {
+			slog.Warn("query larger than -max-udp-size dropped", "client", addr, "max", s.maxUDP)
+			continue
+		}
+		if ip := addrIP(addr); !s.allowed(ip) || !s.underLimit(ip) {
+			continue
+		}
+		m := make([]byte, n)
+		copy(m, b[:n])
+		select {
+		case queue <- packet{conn: conn, m: m, addr: addr}:
+		default:
+		}
+	}
+}
+
+func (s *server) replyUDP(p packet) {
+	rb, err := s.handle(p.m, p.addr, true)
+	if err != nil {
+		slog.Warn("can't reply", "client", p.addr, "err", err)
+		return
+	}
+	n, err := p.conn.WriteTo(rb, p.addr)
+	switch {
+	case err == nil && n < len(rb):
+		slog.Warn("short write", "client", p.addr, "name", questionName(p.m), "written", n, "size", len(rb))
+	case errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOBUFS):
+		// the send buffer is full, the client will retry
+		slog.Debug("reply dropped, socket busy", "client", p.addr, "name", questionName(p.m), "err", err)
+	case err != nil:
+		slog.Warn("can't write to socket", "client", p.addr, "name", questionName(p.m), "err", err)
+	}
+}
+
+// questionName returns the name queried by m for logging, empty if it can't
+// be parsed.
+func questionName(m []byte) string {
+	var p dnsmessage.Parser
+	if _, err := p.Start(m); err != nil {
+		return ""
+	}
+	q, err := p.Question()
+	if err != nil {
+		return ""
+	}
+	return q.Name.String()
+}
+
+// serveTCP accepts connections on ln, plain tcp or tls, until ctx is done and
+// ln is closed.
+func (s *server) serveTCP(ctx context.Context, ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("socket accept error", "err", err)
+			continue
+		}
+		if !s.allowed(addrIP(c.RemoteAddr())) {
+			c.Close()
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleTCP(ctx, c)
+		}()
+	}
+}
+
+// handleTCP serves length-prefixed queries (RFC 1035 4.2.2) until the client
+// closes the connection, stays idle for too long or ctx is done.
+func (s *server) handleTCP(ctx context.Context, c net.Conn) {
+	defer c.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock a pending read, a reply being written still goes out
+			if tc, ok := c.(*net.TCPConn); ok {
+				tc.CloseRead()
+			} else {
+				c.SetReadDeadline(time.Now())
+			}
+		case <-done:
+		}
+	}()
+	var l [2]byte
+	for {
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				slog.Warn("socket read error", "err", err)
+			}
+			return
+		}
+		m := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(c, m); err != nil {
+			// the client went away mid-message
+			if err != io.ErrUnexpectedEOF && ctx.Err() == nil {
+				slog.Warn("socket read error", "err", err)
+			}
+			return
+		}
+		if !s.underLimit(addrIP(c.RemoteAddr())) {
+			return
+		}
+		rb, err := s.handle(m, c.RemoteAddr(), false)
+		if err != nil {
+			slog.Warn("can't reply", "client", c.RemoteAddr(), "err", err)
+			return
+		}
+		if len(rb) > 0xffff {
+			slog.Warn("reply too large", "client", c.RemoteAddr(), "size", len(rb))
+			return
+		}
+		binary.BigEndian.PutUint16(l[:], uint16(len(rb)))
+		if _, err = c.Write(append(l[:], rb...)); err != nil {
+			slog.Warn("can't write to socket", "client", c.RemoteAddr(), "err", err)
+			return
+		}
+	}
+}
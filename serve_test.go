@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heliorosa/dcdns/resolver"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type datagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// fakePacketConn is a net.PacketConn reading the datagrams sent to in and
+// writing replies to out.
+type fakePacketConn struct {
+	in     chan datagram
+	out    chan datagram
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{in: make(chan datagram, 16), out: make(chan datagram, 16), closed: make(chan struct{})}
+}
+
+func (c *fakePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-c.in:
+		return copy(b, d.b), d.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.out <- datagram{append([]byte(nil), b...), addr}
+	return len(b), nil
+}
+
+func (c *fakePacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (c *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func testServer(t *testing.T) *server {
+	t.Helper()
+	nets, err := parseCIDRs(defaultAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{workers: 2, maxUDP: 512}
+	s.allow.Store(&nets)
+	return s
+}
+
+// Datagrams read back to back into the same buffer must each be queued
+// with their own bytes.
+func TestServeUDPCopiesDatagrams(t *testing.T) {
+	s := testServer(t)
+	conn := newFakePacketConn()
+	conn.in <- datagram{packQuery(t, 3, "web.docker."), fakeAddr("no ip")}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	first, second := []byte("first query"), []byte("2nd")
+	conn.in <- datagram{first, client}
+	conn.in <- datagram{second, client}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := make(chan packet, 2)
+	done := make(chan struct{})
+	go func() {
+		s.serveUDP(ctx, conn, queue)
+		close(done)
+	}()
+	p1, p2 := <-queue, <-queue
+	cancel()
+	conn.Close()
+	<-done
+	if !bytes.Equal(p1.m, first) || !bytes.Equal(p2.m, second) {
+		t.Errorf("queued %q and %q, want %q and %q", p1.m, p2.m, first, second)
+	}
+}
+
+// fakeAddr is a client address without an ip.
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "fake" }
+func (a fakeAddr) String() string  { return string(a) }
+
+// A query goes through the worker pool, the resolver and back out of the
+// conn, until serve shuts down. Clients outside -allow, or without an ip,
+// get nothing.
+func TestServeFakeTransport(t *testing.T) {
+	s := testServer(t)
+	// hosts are answered without asking docker
+	s.res = resolver.New(nil, resolver.Config{
+		Suffixes: []string{"docker"},
+		TTL:      60,
+		Hosts:    map[string][]net.IP{"web": {net.IPv4(10, 0, 0, 1)}},
+	})
+	conn := newFakePacketConn()
+	conn.in <- datagram{packQuery(t, 1, "web.docker."), &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}}
+	conn.in <- datagram{packQuery(t, 3, "web.docker."), fakeAddr("no ip")}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	conn.in <- datagram{packQuery(t, 2, "web.docker."), client}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.serve(ctx, []net.PacketConn{conn}, nil)
+		close(done)
+	}()
+	var d datagram
+	select {
+	case d = <-conn.out:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+	cancel()
+	conn.Close()
+	<-done
+
+	var r dnsmessage.Message
+	if err := r.Unpack(d.b); err != nil {
+		t.Fatal(err)
+	}
+	if d.addr != client || r.ID != 2 || len(r.Answers) != 1 {
+		t.Errorf("reply to %v id %d with %d answers, want client, 2 and 1", d.addr, r.ID, len(r.Answers))
+	}
+	if len(conn.out) != 0 {
+		t.Errorf("%d more replies, clients outside -allow got some", len(conn.out))
+	}
+}
+
+func packQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestAllowed(t *testing.T) {
+	s := testServer(t)
+	tests := []struct {
+		ip   net.IP
+		want bool
+	}{
+		{net.IPv4(127, 0, 0, 1), true},
+		{net.IPv4(8, 8, 8, 8), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := s.allowed(tt.ip); got != tt.want {
+			t.Errorf("allowed(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
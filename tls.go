@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+)
+
+// listenTLS opens a DNS over TLS (RFC 7858) listener on port for each of
+// ips, serving the certificate in certFile and keyFile.
+func listenTLS(ips []net.IP, port int, family, certFile, keyFile string) ([]net.Listener, error) {
+	cfg, err := tlsConfig(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var lns []net.Listener
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		_, tcp := listenNetworks(ip, family)
+		ln, err := net.ListenTCP(tcp, &net.TCPAddr{IP: ip, Port: port})
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("can't listen on %s %s: %w", tcp, addr, err)
+		}
+		lns = append(lns, tls.NewListener(ln, cfg))
+		slog.Info("listening", "addr", addr, "tls", tcp)
+	}
+	return lns, nil
+}
+
+// listenDoH opens the DNS over HTTPS listener on addr and loads the
+// certificate it's served with, both of which may need privileges dropped
+// once the server starts. The listener is plain tcp, the http server does
+// the tls handshake with the config returned.
+func listenDoH(addr, certFile, keyFile string) (net.Listener, *tls.Config, error) {
+	cfg, err := tlsConfig(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't listen on %s: %w", addr, err)
+	}
+	slog.Info("listening", "addr", addr, "doh", "tcp")
+	return ln, cfg, nil
+}
+
+// tlsConfig returns the tls settings serving the certificate in certFile
+// and keyFile.
+func tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't load certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// set at build time with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse --short HEAD)"
+var (
+	version = "dev"
+	commit  = "dev"
+)
+
+func versionString() string {
+	return fmt.Sprintf("dcdns %s (commit %s, %s)", version, commit, runtime.Version())
+}